@@ -0,0 +1,129 @@
+// Command nerka serves a directory of markdown pages over HTTP and HTTPS.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/k2l8m11n2/nerka"
+)
+
+// tlsVersions are the versions -tls-min-version accepts
+var tlsVersions = map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+var (
+	addr      = flag.String("addr", "127.0.0.1:8002", "address to serve HTTP on, empty to only serve HTTPS")
+	httpsAddr = flag.String("https-addr", "", "address to also serve HTTPS on")
+	tlsCert   = flag.String("tls-cert", "", "TLS certificate file for -https-addr")
+	tlsKey    = flag.String("tls-key", "", "TLS key file for -https-addr")
+	tlsMin    = flag.String("tls-min-version", "1.2", "lowest TLS version accepted on -https-addr: 1.0, 1.1, 1.2 or 1.3")
+	tlsCipher = flag.String("tls-ciphers", "", "comma-separated TLS 1.0-1.2 cipher suites accepted on -https-addr, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, empty for Go's secure defaults")
+	pprofAddr = flag.String("pprof", "", "serve net/http/pprof on this localhost address")
+)
+
+func main() {
+	nerka.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	var root string
+	switch {
+	case flag.NArg() == 1:
+		root = flag.Arg(0)
+	case flag.NArg() == 0 && os.Getenv("NERKA_ROOT") != "":
+		root = os.Getenv("NERKA_ROOT")
+	default:
+		panic("you need to specify a base directory")
+	}
+	if *addr == "" && *httpsAddr == "" {
+		panic("you need to specify an address to serve on")
+	}
+	if *httpsAddr != "" && (*tlsCert == "" || *tlsKey == "") {
+		panic("-https-addr needs -tls-cert and -tls-key")
+	}
+	tlsConfig := &tls.Config{}
+	version, ok := tlsVersions[*tlsMin]
+	if !ok {
+		panic("invalid TLS version: " + *tlsMin)
+	}
+	tlsConfig.MinVersion = version
+	// insecure suites are only used when named
+	suites := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(*tlsCipher, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := suites[name]
+		if !ok {
+			panic("invalid cipher suite: " + name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	// with an HTTPS listener plain requests don't get secure cookies,
+	// without one TLS is assumed to be terminated in front of nerka
+	var opts []nerka.Option
+	secureCookies := false
+	flag.Visit(func(f *flag.Flag) {
+		secureCookies = secureCookies || f.Name == "secure-cookies"
+	})
+	if *httpsAddr != "" && !secureCookies {
+		opts = append(opts, nerka.WithSecureCookies("tls"))
+	}
+	handler, err := nerka.New(root, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	if *pprofAddr != "" {
+		host, _, err := net.SplitHostPort(*pprofAddr)
+		if ip := net.ParseIP(host); err != nil || host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			panic("pprof address must be on localhost: " + *pprofAddr)
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(*pprofAddr, nil))
+		}()
+	}
+
+	var servers []*http.Server
+	errs := make(chan error, 2)
+	if *addr != "" {
+		srv := &http.Server{Addr: *addr, Handler: handler}
+		go func() { errs <- srv.ListenAndServe() }()
+		servers = append(servers, srv)
+	}
+	if *httpsAddr != "" {
+		srv := &http.Server{Addr: *httpsAddr, Handler: handler, TLSConfig: tlsConfig}
+		go func() { errs <- srv.ListenAndServeTLS(*tlsCert, *tlsKey) }()
+		servers = append(servers, srv)
+	}
+
+	// shut down gracefully on interrupt
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-stop:
+	}
+	handler.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/k2l8m11n2/nerka
 
-go 1.13
+go 1.16
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -8,10 +8,9 @@ require (
 	github.com/go-http-utils/fresh v0.0.0-20161124030543-7231e26a4b27 // indirect
 	github.com/go-http-utils/headers v0.0.0-20181008091004-fed159eddc2a // indirect
 	github.com/gomarkdown/markdown v0.0.0-20210208175418-bda154fe17d8
-	github.com/kr/text v0.2.0 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/tdewolff/minify/v2 v2.9.13
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
-	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	golang.org/x/text v0.3.3
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
@@ -0,0 +1,3536 @@
+// Package nerka serves a directory of markdown pages, rendering them to
+// minified HTML with their links checked.
+package nerka
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"errors"
+	"flag"
+	htmltemplate "html/template"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-http-utils/etag"
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	mhtml "github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
+	"github.com/tdewolff/minify/v2/xml"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maximum length of the X-Broken-Links header value
+const maxBrokenLinksHeader = 2048
+
+// content types overriding the system MIME table
+var contentTypes = map[string]string{
+	".json": "application/json",
+	".xml":  "application/xml",
+}
+
+func typeByExtension(ext string) string {
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelError
+)
+
+var logLevels = map[string]int{"debug": levelDebug, "info": levelInfo, "error": levelError}
+
+func (h *Handler) debugf(format string, v ...interface{}) {
+	if h.logLevel <= levelDebug {
+		h.logger.Printf(format, v...)
+	}
+}
+
+// rotator is a log file that is moved to file.1, file.2 and so on once it
+// would grow past maxSize
+type rotator struct {
+	sync.Mutex
+	name       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func (r *rotator) open() error {
+	file, err := os.OpenFile(r.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotator) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, dropping the oldest, and starts a new file
+func (r *rotator) rotate() error {
+	r.file.Close()
+	for i := r.maxBackups; i > 0; i-- {
+		from := r.name
+		if i > 1 {
+			from += "." + strconv.Itoa(i-1)
+		}
+		os.Rename(from, r.name+"."+strconv.Itoa(i))
+	}
+	if r.maxBackups == 0 {
+		os.Remove(r.name)
+	}
+	return r.open()
+}
+
+// listFlag is a flag that can be given multiple times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// rewrite is a replacement applied to rendered pages
+type rewrite struct {
+	old         string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func (rule rewrite) apply(page []byte) []byte {
+	replacement := []byte(strings.Replace(rule.replacement, "{{year}}", strconv.Itoa(time.Now().Year()), -1))
+	if rule.pattern != nil {
+		return rule.pattern.ReplaceAll(page, replacement)
+	}
+	return bytes.Replace(page, []byte(rule.old), replacement, -1)
+}
+
+// rewriteFlag adds "old=>new" rules to rules
+type rewriteFlag struct {
+	rules  *[]rewrite
+	regexp bool
+}
+
+func (f rewriteFlag) String() string {
+	return ""
+}
+
+func (f rewriteFlag) Set(value string) error {
+	i := strings.Index(value, "=>")
+	if i < 0 {
+		return errors.New("rule must look like old=>new")
+	}
+	rule := rewrite{old: value[:i], replacement: value[i+2:]}
+	if f.regexp {
+		pattern, err := regexp.Compile(rule.old)
+		if err != nil {
+			return err
+		}
+		rule.pattern = pattern
+	}
+	*f.rules = append(*f.rules, rule)
+	return nil
+}
+
+var cacheControl = regexp.MustCompile(`^[a-z-]+(=[0-9]+)?(, *[a-z-]+(=[0-9]+)?)*$`)
+
+var cssIdentifier = regexp.MustCompile(`^-?[_a-zA-Z][_a-zA-Z0-9-]*$`)
+
+var cssLength = regexp.MustCompile(`^(0|[0-9]+(\.[0-9]+)?(px|em|rem|vh|%))$`)
+
+// config holds the values of the options of New
+type config struct {
+	pageCacheHeader   string
+	staticCacheHeader string
+	slashCacheHeader  string
+	versionParam      string
+	versionedHeader   string
+	authCookie        string
+	authMaxAge        time.Duration
+	authOptional      bool
+	secureCookies     string
+	logFile           string
+	logMaxSize        int64
+	logMaxBackups     int
+	accessLog         bool
+	csp               string
+	requestIDHeader   string
+	requestIDIncoming bool
+	logLevelName      string
+	canonicalHost     string
+	brokenLinksHeader bool
+	brokenLinkClass   string
+	externalLinkClass string
+	dlClass           string
+	scrollMargin      string
+	scrollClass       string
+	externalNewTab    bool
+	externalLinkIcon  bool
+	poweredBy         bool
+	nofollow          bool
+	sniff             bool
+	minifyTypes       string
+	minifyJSON        bool
+	jsonLD            string
+	minifyXML         bool
+	imgDimensions     bool
+	imgMaxSize        int64
+	inlineMaxSize     int64
+	wordsPerMinute    int
+	lastmodFormat     string
+	lastmodTimezone   string
+	hardLineBreaks    bool
+	trimSpace         bool
+	autoHeadingIDs    bool
+	headingSlugs      string
+	slugCase          string
+	autolink          bool
+	smartypants       bool
+	rawHTML           string
+	dirListing        bool
+	listingScope      string
+	listingPageSize   int
+	pageNav           string
+	emptyPage         string
+	emptyPlaceholder  string
+	languageList      string
+	excerpts          bool
+	excerptSeparator  string
+	tagPages          bool
+	tagsRefresh       time.Duration
+	eventsPath        string
+	eventsFile        string
+	eventsInterval    time.Duration
+	editURL           string
+	shadow            string
+	drafts            bool
+	foldCase          bool
+	dirRedirect       int
+	spaFallback       string
+	asciidoctor       string
+	rst2html          string
+	convertTimeout    time.Duration
+	txtPages          bool
+	detectCharset     bool
+	pageCache         bool
+	cacheKey          string
+	warm              bool
+	warmWorkers       int
+	maxRenders        int
+	siteName          string
+	noBranding        bool
+	titleFormat       string
+	dir               string
+	contentDir        string
+	followHosts       listFlag
+	sameTabHosts      listFlag
+	stylesheets       listFlag
+	scripts           listFlag
+	headerFlags       listFlag
+	forceHeaderFlags  listFlag
+	authTokens        listFlag
+	vhosts            listFlag
+	aliasFlags        listFlag
+	// rewrites are the rules given with -replace and -replace-regexp, in order
+	rewrites []rewrite
+}
+
+// register defines the options as flags of fs setting c
+func (c *config) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.pageCacheHeader, "page-cache-control", "max-age=10", "Cache-Control of rendered pages, overridable with a cache frontmatter field")
+	fs.StringVar(&c.staticCacheHeader, "static-cache-control", "max-age=300, stale-while-revalidate=28800", "Cache-Control of static files")
+	fs.StringVar(&c.slashCacheHeader, "redirect-cache-control", "max-age=604800", "Cache-Control of trailing slash redirects")
+	fs.StringVar(&c.versionParam, "version-param", "v", "query parameter busting caches of static files, which are then served with -versioned-cache-control (empty for none)")
+	fs.StringVar(&c.versionedHeader, "versioned-cache-control", "max-age=31536000, immutable", "Cache-Control of static files requested with -version-param")
+	fs.StringVar(&c.authCookie, "auth-cookie", "nerka", "name of the auth cookie")
+	fs.DurationVar(&c.authMaxAge, "auth-max-age", 365*24*time.Hour, "how long auth cookies last")
+	fs.BoolVar(&c.authOptional, "auth-optional", false, "serve visitors without an auth cookie too, leaving out the {{#auth}}...{{/auth}} blocks of pages for them")
+	fs.StringVar(&c.secureCookies, "secure-cookies", "always", "when to mark auth cookies secure: always, with TLS terminated in front of nerka, or on tls requests only")
+	fs.StringVar(&c.logFile, "log-file", "", "file to log to instead of stderr")
+	fs.Int64Var(&c.logMaxSize, "log-max-size", 100, "megabytes the -log-file grows to before it is rotated")
+	fs.IntVar(&c.logMaxBackups, "log-max-backups", 3, "number of rotated -log-file backups kept")
+	fs.BoolVar(&c.accessLog, "access-log", false, "log every request")
+	fs.StringVar(&c.csp, "csp", "", "Content-Security-Policy of rendered pages, {{nonce}} standing for a fresh nonce given to their scripts and styles outside data-no-minify elements")
+	fs.StringVar(&c.requestIDHeader, "request-id-header", "", "header, like X-Request-ID, to give every request and its response an id in, logged with it")
+	fs.BoolVar(&c.requestIDIncoming, "request-id-incoming", true, "keep the -request-id-header id requests come with instead of generating one")
+	fs.StringVar(&c.logLevelName, "log-level", "info", "least severe messages logged (debug, info or error), debug including broken links on rendered pages")
+	fs.StringVar(&c.canonicalHost, "canonical-host", "", "host, like example.com, to redirect requests for any other host to over HTTPS")
+	fs.BoolVar(&c.brokenLinksHeader, "broken-links-header", false, "list broken link targets in an X-Broken-Links response header")
+	fs.StringVar(&c.brokenLinkClass, "broken-link-class", "broken-link", "class added to links to missing pages")
+	fs.StringVar(&c.externalLinkClass, "external-link-class", "external-link", "class added to links to other hosts")
+	fs.StringVar(&c.dlClass, "dl-class", "", "class added to definition lists")
+	fs.StringVar(&c.scrollMargin, "scroll-margin", "", "scroll-margin-top, like 4rem, of headings with an id, so anchors land below a fixed header (empty for none)")
+	fs.StringVar(&c.scrollClass, "scroll-margin-class", "anchor-offset", "class given to headings with an id for -scroll-margin")
+	fs.BoolVar(&c.externalNewTab, "external-new-tab", false, "open links to other hosts in a new tab")
+	fs.BoolVar(&c.externalLinkIcon, "external-link-icon", false, "append an arrow span, with the -external-link-class class suffixed -icon, to links to other hosts without an image")
+	fs.BoolVar(&c.poweredBy, "powered-by", false, "end pages with a footer of class powered-by crediting nerka, unless the page already has an element of that class")
+	fs.BoolVar(&c.nofollow, "nofollow", false, "add rel=nofollow to links to other hosts")
+	fs.BoolVar(&c.sniff, "sniff", true, "sniff the type of files with unknown extensions")
+	fs.StringVar(&c.minifyTypes, "minify", "html,css,js,svg,json,xml", "comma-separated types to minify")
+	fs.BoolVar(&c.minifyJSON, "minify-json", true, "deprecated, false is like leaving json out of -minify")
+	fs.StringVar(&c.jsonLD, "json-ld", "minify", "what HTML minification does to JSON-LD scripts: minify them as JSON, keeping ones that aren't valid JSON as they are, or verbatim")
+	fs.BoolVar(&c.minifyXML, "minify-xml", true, "deprecated, false is like leaving xml out of -minify")
+	fs.BoolVar(&c.imgDimensions, "img-dimensions", false, "add width and height to local images")
+	fs.Int64Var(&c.imgMaxSize, "img-max-size", 10<<20, "size in bytes above which -img-dimensions leaves images alone")
+	fs.Int64Var(&c.inlineMaxSize, "inline-max-size", 0, "size in bytes up to which local images and stylesheets are inlined into pages, 0 to never inline")
+	fs.IntVar(&c.wordsPerMinute, "wpm", 200, "reading speed the [[readingtime]] placeholder is estimated with")
+	fs.StringVar(&c.lastmodFormat, "lastmod-format", "2006-01-02", "time layout the [[lastmod]] placeholder is formatted with")
+	fs.StringVar(&c.lastmodTimezone, "lastmod-tz", "Local", "time zone the [[lastmod]] placeholder is formatted in")
+	fs.BoolVar(&c.hardLineBreaks, "hard-line-breaks", false, "render newlines in paragraphs as line breaks")
+	fs.BoolVar(&c.trimSpace, "trim-space", false, "turn CRLF line endings into LF and trim trailing whitespace outside fenced code before rendering markdown, dropping two-space line breaks")
+	fs.BoolVar(&c.autoHeadingIDs, "auto-heading-ids", false, "give headings ids generated from their text")
+	fs.StringVar(&c.headingSlugs, "heading-slugs", "markdown", "how -auto-heading-ids makes ids: markdown, turning runs of other characters than letters and digits into a hyphen, or github, like GitHub anchors")
+	fs.StringVar(&c.slugCase, "slug-case", "lower", "case of -auto-heading-ids ids: lower, or keep for the case of the heading")
+	fs.BoolVar(&c.autolink, "autolink", true, "link bare URLs in markdown text, outside code")
+	fs.BoolVar(&c.smartypants, "smartypants", false, "render smart quotes, dashes, ellipses and fractions outside code")
+	fs.StringVar(&c.rawHTML, "raw-html", "allow", "what to do with HTML embedded in markdown (allow, skip or escape)")
+	fs.BoolVar(&c.dirListing, "listing", false, "list the contents of directories without an index")
+	fs.StringVar(&c.listingScope, "listing-scope", "all", "directories -listing lists: all, or root for just the base directory")
+	fs.IntVar(&c.listingPageSize, "listing-page-size", 50, "number of entries per page of a directory listing")
+	fs.StringVar(&c.pageNav, "page-nav", "", "link pages to the previous and next page in their directory: order, as listed in its .order file, or alpha, by name (empty for none)")
+	fs.StringVar(&c.emptyPage, "empty-page", "render", "what pages without content besides frontmatter serve: render, 404, or placeholder for -empty-placeholder")
+	fs.StringVar(&c.emptyPlaceholder, "empty-placeholder", "*This page is empty.*", "markdown rendered for empty pages with -empty-page placeholder")
+	fs.StringVar(&c.languageList, "languages", "", "comma-separated languages pages like page.fr.md are in, the first being the default, chosen by a lang query parameter or Accept-Language (empty to not negotiate)")
+	fs.BoolVar(&c.excerpts, "excerpts", false, "show excerpts of pages in listings")
+	fs.StringVar(&c.excerptSeparator, "excerpt-separator", "<!--more-->", "marks the end of a page's excerpt, which is its first paragraph otherwise")
+	fs.BoolVar(&c.tagPages, "tags", false, "serve listings of pages by their tags frontmatter field under /tags/")
+	fs.DurationVar(&c.tagsRefresh, "tags-refresh", 10*time.Second, "how often the -tags index rereads the pages that changed")
+	fs.StringVar(&c.eventsPath, "events", "", "path, like /events, to stream server-sent events on")
+	fs.StringVar(&c.eventsFile, "events-file", "", "file whose appended lines are sent as -events, instead of pings")
+	fs.DurationVar(&c.eventsInterval, "events-interval", 10*time.Second, "interval to ping or check the -events-file at")
+	fs.StringVar(&c.editURL, "edit-url", "", "URL to edit markdown pages at, with {path} standing for the source file like https://github.com/user/repo/edit/main/{path}")
+	fs.StringVar(&c.shadow, "shadow", "page", "what a path like /foo serves when both foo.md and the directory foo exist: page, redirecting /foo/ to it, or dir, redirecting /foo to the directory")
+	fs.BoolVar(&c.drafts, "drafts", false, "serve, list and index directories marked as drafts by a .draft file too")
+	fs.BoolVar(&c.foldCase, "fold-case", false, "redirect paths that only match a page, file or directory ignoring case to its actual case, scanning directories for it")
+	fs.IntVar(&c.dirRedirect, "dir-redirect", 303, "status to redirect directories without a trailing slash and pages with one with, or 0 to serve directory indexes at both")
+	fs.StringVar(&c.spaFallback, "spa-fallback", "", "file below the base directory served for paths matching no page, like 200.html")
+	fs.StringVar(&c.asciidoctor, "asciidoctor", "", "asciidoctor command to render .adoc pages with, which are served as is without it")
+	fs.StringVar(&c.rst2html, "rst2html", "", "rst2html command to render .rst pages with, which are served as is without it")
+	fs.DurationVar(&c.convertTimeout, "convert-timeout", 10*time.Second, "how long -asciidoctor and -rst2html may take to render a page")
+	fs.BoolVar(&c.txtPages, "txt-pages", false, "render .txt files as pages of preformatted text at their path without the extension, like /notes for notes.txt, while /notes.txt and files like robots.txt stay as they are")
+	fs.BoolVar(&c.detectCharset, "detect-charset", false, "transcode pages that aren't UTF-8 from a detected encoding")
+	fs.BoolVar(&c.pageCache, "cache", false, "cache rendered pages until their source changes")
+	fs.StringVar(&c.cacheKey, "cache-key", "mtime", "what tells -cache that a source changed: its mtime and size or its content hash")
+	fs.BoolVar(&c.warm, "warm", false, "render every page into the -cache at startup")
+	fs.IntVar(&c.warmWorkers, "warm-workers", runtime.GOMAXPROCS(0), "number of pages rendered at once by -warm")
+	fs.IntVar(&c.maxRenders, "max-renders", 4*runtime.GOMAXPROCS(0), "maximum number of pages rendered at once, 0 for no limit")
+	fs.StringVar(&c.siteName, "site-name", "nerka", "site name used in page titles")
+	fs.BoolVar(&c.noBranding, "no-branding", false, "title pages with just the heading or path instead of prefixing the site name")
+	fs.StringVar(&c.titleFormat, "title-format", "", "page title format with {{page}} and {{site}} placeholders, {{page}} being the first heading or the path")
+	fs.StringVar(&c.dir, "dir", "ltr", "text direction of pages (ltr, rtl or auto), overridable with a dir frontmatter field")
+	fs.StringVar(&c.contentDir, "content-dir", "", "directory below the base directory to serve pages and files from, leaving .auth, .header, .listing.html and .500.html at the base (empty to serve the base directory)")
+	fs.Var(&c.followHosts, "follow-host", "host (and its subdomains) exempt from -nofollow, can be repeated")
+	fs.Var(&c.sameTabHosts, "same-tab-host", "host (and its subdomains) exempt from -external-new-tab, can be repeated")
+	fs.Var(&c.stylesheets, "css", "stylesheet URL linked from every page, can be repeated")
+	fs.Var(&c.scripts, "js", "script URL loaded by every page, can be repeated")
+	fs.Var(rewriteFlag{&c.rewrites, false}, "replace", "old=>new replacement applied to rendered pages outside data-no-minify elements, {{year}} in new being the current year, can be repeated")
+	fs.Var(rewriteFlag{&c.rewrites, true}, "replace-regexp", "like -replace but with a regular expression, can be repeated")
+	fs.Var(&c.headerFlags, "header", "\"Name: Value\" response header added unless nerka sets it, can be repeated")
+	fs.Var(&c.authTokens, "auth-token", "token accepted besides the ones in .auth, can be repeated")
+	fs.Var(&c.forceHeaderFlags, "force-header", "\"Name: Value\" response header replacing the one nerka sets, can be repeated")
+	fs.Var(&c.aliasFlags, "alias", "/path=/file serving the page or file /file at /path, can be repeated")
+	fs.Var(&c.vhosts, "vhost", "host=dir serving the directory dir to requests for host instead of the base directory, can be repeated")
+}
+
+// options are the flags configuring New, set on the command line with
+// RegisterFlags
+var options = flag.NewFlagSet("nerka", flag.ContinueOnError)
+
+// defaults are the values of options
+var defaults config
+
+// clone returns a copy of c not sharing its lists
+func (c config) clone() config {
+	for _, list := range []*listFlag{&c.followHosts, &c.sameTabHosts, &c.stylesheets, &c.scripts, &c.headerFlags, &c.forceHeaderFlags, &c.authTokens, &c.vhosts, &c.aliasFlags} {
+		*list = append(listFlag(nil), *list...)
+	}
+	c.rewrites = append([]rewrite(nil), c.rewrites...)
+	return c
+}
+
+func init() {
+	defaults.register(options)
+}
+
+// within reports whether file is the directory base or inside it
+func within(base, file string) bool {
+	rel, err := filepath.Rel(base, file)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// site is a file system pages are served from, the base directory by
+// default, with the caches of what was read from it
+type site struct {
+	*Handler
+	files fs.FS
+	// control is the site of files like .auth and .header, the site itself
+	// unless there is a -content-dir
+	control *site
+	// includes caches include files like .header by name
+	includes fileCache
+	// pages caches rendered pages by name with -cache
+	pages fileCache
+	// hashed caches rendered pages with -cache-key hash
+	hashed contentCache
+	tags   tagIndex
+	// shadowed holds the pages found to share their name with a directory
+	shadowed sync.Map
+}
+
+func (h *Handler) newSite(files fs.FS) *site {
+	s := &site{
+		Handler:  h,
+		files:    files,
+		includes: fileCache{entries: map[string]cacheEntry{}},
+		pages:    fileCache{entries: map[string]cacheEntry{}},
+		hashed:   contentCache{pages: map[string][]byte{}, names: map[string]string{}},
+		tags:     tagIndex{tags: map[string][]dirEntry{}},
+	}
+	s.control = s
+	return s
+}
+
+// siteFS returns the site of the file system files, serving pages from
+// its -content-dir if there is one
+func (h *Handler) siteFS(files fs.FS) (*site, error) {
+	if h.contentDir == "" {
+		return h.newSite(files), nil
+	}
+	var content fs.FS
+	if root, ok := files.(dirFS); ok {
+		// symlinks in the content directory have to stay within it
+		dir := filepath.Join(string(root), h.contentDir)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() || !within(string(root), dir) || dir == filepath.Clean(string(root)) {
+			return nil, errors.New("content directory is not a directory below " + string(root) + ": " + h.contentDir)
+		}
+		content = dirFS(dir)
+	} else {
+		dir := path.Clean(filepath.ToSlash(h.contentDir))
+		if info, err := fs.Stat(files, dir); err != nil || !info.IsDir() || dir == "." {
+			return nil, errors.New("content directory is not a directory below the base directory: " + h.contentDir)
+		}
+		sub, err := fs.Sub(files, dir)
+		if err != nil {
+			return nil, err
+		}
+		content = sub
+	}
+	s := h.newSite(content)
+	s.control = h.newSite(files)
+	return s, nil
+}
+
+// siteFor returns the site serving host
+func (h *Handler) siteFor(host string) *site {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if s, ok := h.sites[strings.ToLower(host)]; ok {
+		return s
+	}
+	return h.defaultSite
+}
+
+// dirFS is a directory as a file system, following symlinks as long as they
+// stay within the directory
+type dirFS string
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	file, err := dir.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+func (dir dirFS) Stat(name string) (fs.FileInfo, error) {
+	file, err := dir.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(file)
+}
+
+// resolve maps a path in the file system to a file
+func (dir dirFS) resolve(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	base, err := filepath.Abs(string(dir))
+	if err != nil {
+		return "", err
+	}
+	base, err = filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(base, filepath.FromSlash(name))
+	if !within(base, file) {
+		return "", errors.New("open " + file + ": directory traversal attack")
+	}
+	real, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", err
+	}
+	if !within(base, real) {
+		return "", errors.New("open " + file + ": symlink points outside the base directory")
+	}
+	return real, nil
+}
+
+// sitePath maps a slash-separated path below the base directory to a path
+// in the site file system
+func sitePath(name string) (string, error) {
+	clean := path.Clean(strings.TrimLeft(name, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New("open " + name + ": directory traversal attack")
+	}
+	return clean, nil
+}
+
+func (s *site) read(name string) ([]byte, error) {
+	file, err := sitePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(s.files, file)
+}
+
+func (s *site) stat(name string) (os.FileInfo, error) {
+	file, err := sitePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(s.files, file)
+}
+
+func (h *Handler) isPage(ext string) bool {
+	for _, pageExt := range h.pageExts {
+		if ext == pageExt {
+			return true
+		}
+	}
+	return false
+}
+
+// readExt reads the page name from the first source found, converting
+// notebooks to markdown
+func (s *site) readExt(ctx context.Context, name string) ([]byte, error) {
+	for _, ext := range s.pageExts {
+		file, err := s.read(name + ext)
+		if err == nil && ext == ".ipynb" {
+			return notebook(file)
+		}
+		if err == nil && ext == ".adoc" {
+			return s.asciidoc(ctx, file)
+		}
+		if err == nil && ext == ".rst" {
+			return s.restructuredText(ctx, file)
+		}
+		if err == nil && ext == ".txt" {
+			return plainText(file), nil
+		}
+		if err == nil {
+			return file, nil
+		}
+	}
+	return s.read(name)
+}
+
+// plainText wraps a text page in a code block with -txt-pages, which the
+// renderer escapes
+func plainText(data []byte) []byte {
+	return []byte(fence(string(data), "text"))
+}
+
+// convert runs an external converter on a page, passing it on stdin, and
+// kills it once ctx is done or it took -convert-timeout
+func (h *Handler) convert(ctx context.Context, command string, data []byte, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.convertTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && ctx.Err() != nil {
+		return nil, errors.New(command + ": " + ctx.Err().Error())
+	}
+	if err != nil && stderr.Len() > 0 {
+		return nil, errors.New(command + ": " + strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// asciidoc converts an AsciiDoc page to an HTML fragment with -asciidoctor
+func (h *Handler) asciidoc(ctx context.Context, data []byte) ([]byte, error) {
+	return h.convert(ctx, h.asciidoctor, data, "--no-header-footer", "--safe-mode", "secure", "--out-file", "-", "-")
+}
+
+// restructuredText converts a reStructuredText page to an HTML fragment with
+// -rst2html, which only writes whole documents. Like asciidoctor's secure
+// mode, pages can't include other files, or raw HTML unless -raw-html
+// allows it.
+func (h *Handler) restructuredText(ctx context.Context, data []byte) ([]byte, error) {
+	args := []string{"--no-file-insertion"}
+	if h.rawHTML != "allow" {
+		args = append(args, "--no-raw")
+	}
+	out, err := h.convert(ctx, h.rst2html, data, args...)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(bytes.NewReader(out))
+	if err != nil {
+		return nil, err
+	}
+	var body *html.Node
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "body" {
+			body = n
+		}
+		for c := n.FirstChild; c != nil && body == nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+	var fragment bytes.Buffer
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		html.Render(&fragment, c)
+	}
+	return fragment.Bytes(), nil
+}
+
+// notebookText is notebook text, given as a string or a list of lines
+type notebookText string
+
+func (t *notebookText) UnmarshalJSON(data []byte) error {
+	var lines []string
+	if err := stdjson.Unmarshal(data, &lines); err == nil {
+		*t = notebookText(strings.Join(lines, ""))
+		return nil
+	}
+	return stdjson.Unmarshal(data, (*string)(t))
+}
+
+type notebookOutput struct {
+	OutputType string                  `json:"output_type"`
+	Text       notebookText            `json:"text"`
+	Data       map[string]notebookText `json:"data"`
+	Traceback  []string                `json:"traceback"`
+}
+
+type notebookCell struct {
+	CellType string           `json:"cell_type"`
+	Source   notebookText     `json:"source"`
+	Outputs  []notebookOutput `json:"outputs"`
+}
+
+// ansiEscape matches the color codes in tracebacks
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// fence wraps code in a fenced code block of the language
+func fence(code, language string) string {
+	marker := "```"
+	for strings.Contains(code, marker) {
+		marker += "`"
+	}
+	return marker + language + "\n" + strings.TrimSuffix(code, "\n") + "\n" + marker + "\n\n"
+}
+
+// notebook converts a Jupyter notebook to markdown, with code cells as
+// fenced code and outputs as code, images or HTML
+func notebook(data []byte) ([]byte, error) {
+	var nb struct {
+		Cells    []notebookCell `json:"cells"`
+		Metadata struct {
+			LanguageInfo struct {
+				Name string `json:"name"`
+			} `json:"language_info"`
+		} `json:"metadata"`
+	}
+	if err := stdjson.Unmarshal(data, &nb); err != nil {
+		return nil, err
+	}
+	var md strings.Builder
+	for _, cell := range nb.Cells {
+		switch cell.CellType {
+		case "markdown":
+			md.WriteString(strings.TrimSuffix(string(cell.Source), "\n") + "\n\n")
+		case "code":
+			md.WriteString(fence(string(cell.Source), nb.Metadata.LanguageInfo.Name))
+			for _, output := range cell.Outputs {
+				md.WriteString(notebookOutputMarkdown(output))
+			}
+		default:
+			md.WriteString(fence(string(cell.Source), ""))
+		}
+	}
+	return []byte(md.String()), nil
+}
+
+// notebookOutputMarkdown converts a code cell output to markdown,
+// preferring images over HTML over plain text
+func notebookOutputMarkdown(output notebookOutput) string {
+	switch output.OutputType {
+	case "stream":
+		return fence(string(output.Text), "")
+	case "error":
+		return fence(ansiEscape.ReplaceAllString(strings.Join(output.Traceback, "\n"), ""), "")
+	}
+	for _, contentType := range []string{"image/png", "image/jpeg", "image/gif"} {
+		if image, ok := output.Data[contentType]; ok {
+			return "![output](data:" + contentType + ";base64," + strings.Replace(string(image), "\n", "", -1) + ")\n\n"
+		}
+	}
+	if image, ok := output.Data["image/svg+xml"]; ok {
+		return "![output](data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(image)) + ")\n\n"
+	}
+	if markup, ok := output.Data["text/html"]; ok {
+		return "<div class=\"output\">\n" + string(markup) + "\n</div>\n\n"
+	}
+	if text, ok := output.Data["text/plain"]; ok {
+		return fence(string(text), "")
+	}
+	return ""
+}
+
+// pageEncoding returns the encoding named in the .charset file nearest to
+// the page name, or nil if there is none
+func (s *site) pageEncoding(name string) encoding.Encoding {
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if data, err := s.read(path.Join(dir, ".charset")); err == nil {
+			enc, err := htmlindex.Get(strings.TrimSpace(string(data)))
+			if err != nil {
+				return nil
+			}
+			return enc
+		}
+		if dir == "/" || dir == "." {
+			return nil
+		}
+	}
+}
+
+// decode transcodes the page name to UTF-8 from its .charset encoding, or
+// from a detected one with -detect-charset if it isn't valid UTF-8
+func (s *site) decode(name string, file []byte) []byte {
+	enc := s.pageEncoding(name)
+	if enc == nil {
+		if !s.detectCharset || utf8.Valid(file) {
+			return file
+		}
+		enc, _, _ = charset.DetermineEncoding(file, "text/html")
+	}
+	decoded, err := enc.NewDecoder().Bytes(file)
+	if err != nil {
+		return file
+	}
+	return decoded
+}
+
+// frontmatter splits a leading block of "key: value" lines fenced by "---"
+// lines off the file, leaving the file as it is when a line in between is
+// something else, like the text of a setext heading or between thematic
+// breaks
+func frontmatter(file []byte) (map[string]string, []byte) {
+	meta := map[string]string{}
+	lines := strings.SplitAfter(string(file), "\n")
+	if strings.TrimSpace(lines[0]) != "---" {
+		return meta, file
+	}
+	offset := len(lines[0])
+	for _, line := range lines[1:] {
+		offset += len(line)
+		if strings.TrimSpace(line) == "---" && len(meta) > 0 {
+			return meta, file[offset:]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 || strings.TrimSpace(line[:i]) == "" {
+			break
+		}
+		meta[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return map[string]string{}, file
+}
+
+func (s *site) readInfo(name string) (os.FileInfo, error) {
+	for _, ext := range s.pageExts {
+		info, err := s.stat(name + ext)
+		if err == nil {
+			return info, nil
+		}
+	}
+	return s.stat(name)
+}
+
+// pageOrDir is readInfo for the request path name, picking the page or the
+// directory by -shadow when both exist and warning about it once
+func (s *site) pageOrDir(name string) (os.FileInfo, error) {
+	if name != "/" {
+		name = strings.TrimSuffix(name, "/")
+	}
+	info, err := s.readInfo(name)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	dirInfo, err := s.stat(name)
+	if err != nil || !dirInfo.IsDir() {
+		return info, nil
+	}
+	if _, warned := s.shadowed.LoadOrStore(name, true); !warned {
+		s.logger.Printf("%s: a page and a directory share the name, -shadow is %s", name, s.shadow)
+	}
+	if s.shadow == "dir" {
+		return dirInfo, nil
+	}
+	return info, nil
+}
+
+type cacheEntry struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+// fileCache holds data derived from files until they change
+type fileCache struct {
+	sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func (c *fileCache) get(name string, info os.FileInfo) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cached, ok := c.entries[name]
+	if !ok || !cached.modTime.Equal(info.ModTime()) || cached.size != info.Size() {
+		return nil, false
+	}
+	return cached.data, true
+}
+
+func (c *fileCache) put(name string, info os.FileInfo, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[name] = cacheEntry{info.ModTime(), info.Size(), data}
+}
+
+// readInclude is readExt for include files, cached until they change
+func (s *site) readInclude(name string) ([]byte, error) {
+	info, err := s.readInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := s.includes.get(name, info); ok {
+		return data, nil
+	}
+	data, err := s.readExt(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	s.includes.put(name, info, data)
+	return data, nil
+}
+
+// contentCache holds rendered pages by the hash of their source, for as
+// long as a page has that source
+type contentCache struct {
+	sync.Mutex
+	pages map[string][]byte
+	names map[string]string
+}
+
+func (c *contentCache) get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	md, ok := c.pages[key]
+	return md, ok
+}
+
+func (c *contentCache) put(name, key string, md []byte) {
+	c.Lock()
+	defer c.Unlock()
+	old, ok := c.names[name]
+	c.names[name] = key
+	c.pages[key] = md
+	if !ok || old == key {
+		return
+	}
+	for _, other := range c.names {
+		if other == old {
+			return
+		}
+	}
+	delete(c.pages, old)
+}
+
+// renderPage is renderMarkdown for the source of the page name, cached until
+// the page changes with -cache
+func (s *site) renderPage(name string, source []byte) []byte {
+	if !s.pageCache {
+		return s.renderMarkdown(source)
+	}
+	if s.cacheKey == "hash" {
+		sum := sha256.Sum256(source)
+		key := string(sum[:])
+		md, ok := s.hashed.get(key)
+		if !ok {
+			md = s.renderMarkdown(source)
+		}
+		s.hashed.put(name, key, md)
+		return md
+	}
+	info, err := s.readInfo(name)
+	if err != nil {
+		return s.renderMarkdown(source)
+	}
+	if md, ok := s.pages.get(name, info); ok {
+		return md
+	}
+	md := s.renderMarkdown(source)
+	s.pages.put(name, info, md)
+	return md
+}
+
+// warmCache renders every page into the page cache
+func (s *site) warmCache() error {
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < s.warmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if file, err := s.readExt(context.Background(), name); err == nil {
+					_, file = frontmatter(s.decode(name, file))
+					s.renderPage(name, file)
+				}
+			}
+		}()
+	}
+	err := s.walkPages(func(name, file string, info os.FileInfo) {
+		names <- name
+	})
+	close(names)
+	wg.Wait()
+	return err
+}
+
+func (h *Handler) renderMarkdown(source []byte) []byte {
+	if h.trimSpace {
+		source = normalizeSpace(source)
+	}
+	extensions := parser.CommonExtensions | parser.Attributes
+	if !h.autolink {
+		extensions &^= parser.Autolink
+	}
+	if h.hardLineBreaks {
+		extensions |= parser.HardLineBreak
+	}
+	if h.autoHeadingIDs {
+		extensions |= parser.AutoHeadingIDs
+	}
+	flags := mdhtml.FlagsNone
+	if h.smartypants {
+		flags |= mdhtml.CommonFlags
+	}
+	options := mdhtml.RendererOptions{}
+	switch h.rawHTML {
+	case "skip":
+		flags |= mdhtml.SkipHTML
+	case "escape":
+		options.RenderNodeHook = escapeHTML
+	}
+	options.Flags = flags
+	// headings still without an id after parsing have none given in the
+	// source, the parser only making ids for -heading-slugs markdown and
+	// -slug-case lower
+	slugs := h.autoHeadingIDs && (h.headingSlugs != "markdown" || h.slugCase != "lower")
+	if slugs {
+		extensions &^= parser.AutoHeadingIDs
+	}
+	doc := markdown.Parse(source, parser.NewWithExtensions(extensions))
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		heading, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		headingAttributes(heading)
+		if slugs && heading.HeadingID == "" {
+			heading.HeadingID = slugifiers[h.headingSlugs](headingText(heading))
+			if h.slugCase == "lower" {
+				heading.HeadingID = strings.ToLower(heading.HeadingID)
+			}
+		}
+		return ast.GoToNext
+	})
+	return markdown.Render(doc, mdhtml.NewRenderer(options))
+}
+
+// headingAttributes makes the id of {#id .class} given for a heading its
+// only id, over one the parser made, and splits the classes and key=value
+// attributes of {#id .class} after the heading text off the id the parser
+// takes it all as
+func headingAttributes(heading *ast.Heading) {
+	if heading.Attribute != nil && heading.Attribute.ID != nil {
+		heading.HeadingID = string(heading.Attribute.ID)
+		heading.Attribute.ID = nil
+	}
+	fields := strings.Fields(heading.HeadingID)
+	if len(fields) < 2 {
+		return
+	}
+	if heading.Attribute == nil {
+		heading.Attribute = &ast.Attribute{}
+	}
+	heading.HeadingID = ""
+	for _, field := range fields {
+		switch i := strings.IndexByte(field, '='); {
+		case strings.HasPrefix(field, "."):
+			heading.Attribute.Classes = append(heading.Attribute.Classes, []byte(field[1:]))
+		case i > 0:
+			if heading.Attribute.Attrs == nil {
+				heading.Attribute.Attrs = map[string][]byte{}
+			}
+			heading.Attribute.Attrs[field[:i]] = []byte(strings.Trim(field[i+1:], `"'`))
+		case heading.HeadingID == "":
+			heading.HeadingID = strings.TrimPrefix(field, "#")
+		}
+	}
+}
+
+// slugifiers make heading ids for -heading-slugs in the case of the
+// heading, markdown being left to the parser for -slug-case lower
+var slugifiers = map[string]func(string) string{"markdown": markdownSlug, "github": githubSlug}
+
+// markdownSlug is the parser's heading id without lowercasing: runs of
+// other characters than letters and digits turned into a hyphen
+func markdownSlug(text string) string {
+	var slug []rune
+	dash := false
+	for _, r := range text {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+			dash = true
+			continue
+		}
+		if dash && len(slug) > 0 {
+			slug = append(slug, '-')
+		}
+		dash = false
+		slug = append(slug, r)
+	}
+	return string(slug)
+}
+
+// githubSlug is the anchor GitHub gives a heading, before lowercasing:
+// spaces turned into hyphens and punctuation left out
+func githubSlug(text string) string {
+	var slug []rune
+	for _, r := range strings.TrimSpace(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r) || r == '-' || r == '_':
+			slug = append(slug, r)
+		case r == ' ':
+			slug = append(slug, '-')
+		}
+	}
+	return string(slug)
+}
+
+// headingText is the text of a parsed heading without the markup
+func headingText(heading *ast.Heading) string {
+	var text strings.Builder
+	ast.WalkFunc(heading, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch node := node.(type) {
+		case *ast.Text:
+			text.Write(node.Literal)
+		case *ast.Code:
+			text.Write(node.Literal)
+		}
+		return ast.GoToNext
+	})
+	return text.String()
+}
+
+// normalizeSpace turns CRLF and CR line endings into LF and trims trailing
+// whitespace off lines outside fenced code blocks
+func normalizeSpace(source []byte) []byte {
+	source = bytes.Replace(source, []byte("\r\n"), []byte("\n"), -1)
+	source = bytes.Replace(source, []byte("\r"), []byte("\n"), -1)
+	lines := bytes.Split(source, []byte("\n"))
+	var fence []byte
+	for i, line := range lines {
+		marker := bytes.TrimLeft(line, " ")
+		n := 0
+		if len(line)-len(marker) <= 3 && (bytes.HasPrefix(marker, []byte("```")) || bytes.HasPrefix(marker, []byte("~~~"))) {
+			n = len(marker) - len(bytes.TrimLeft(marker, string(marker[:1])))
+		}
+		switch {
+		case fence == nil && n > 0:
+			fence = marker[:n]
+		case fence == nil:
+		case n >= len(fence) && marker[0] == fence[0] && len(bytes.TrimSpace(marker[n:])) == 0:
+			fence = nil
+		default:
+			continue
+		}
+		lines[i] = bytes.TrimRight(line, " \t")
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// escapeHTML renders HTML embedded in markdown as text
+func escapeHTML(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	switch node := node.(type) {
+	case *ast.HTMLBlock:
+		io.WriteString(w, "<p>")
+		mdhtml.EscapeHTML(w, node.Literal)
+		io.WriteString(w, "</p>\n")
+		return ast.GoToNext, true
+	case *ast.HTMLSpan:
+		mdhtml.EscapeHTML(w, node.Literal)
+		return ast.GoToNext, true
+	}
+	return ast.GoToNext, false
+}
+
+// parseContent parses rendered content as the children of a body element
+func parseContent(content []byte) ([]*html.Node, error) {
+	return html.ParseFragment(bytes.NewReader(content), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+}
+
+// textContent returns the text of n and its descendants with whitespace
+// collapsed
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func isHeading(tag string) bool {
+	return len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6'
+}
+
+// firstHeading returns the text of the first h1 in rendered content, or of
+// the first heading of any level if there is no h1
+func firstHeading(nodes []*html.Node) string {
+	var find func(*html.Node, func(string) bool) string
+	find = func(n *html.Node, match func(string) bool) string {
+		if n.Type == html.ElementNode && match(n.Data) {
+			return textContent(n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if text := find(c, match); text != "" {
+				return text
+			}
+		}
+		return ""
+	}
+	for _, match := range []func(string) bool{
+		func(tag string) bool { return tag == "h1" },
+		isHeading,
+	} {
+		for _, n := range nodes {
+			if text := find(n, match); text != "" {
+				return text
+			}
+		}
+	}
+	return ""
+}
+
+// wordCount counts the words of visible text outside of code
+func wordCount(nodes []*html.Node) int {
+	count := 0
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && (n.Data == "pre" || n.Data == "code" || n.Data == "script" || n.Data == "style") {
+			return
+		}
+		if n.Type == html.TextNode {
+			count += len(strings.Fields(n.Data))
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	for _, n := range nodes {
+		f(n)
+	}
+	return count
+}
+
+// inCode reports whether n is inside a code block or inline code
+func inCode(n *html.Node) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type == html.ElementNode && (p.Data == "pre" || p.Data == "code") {
+			return true
+		}
+	}
+	return false
+}
+
+type dirEntry struct {
+	Name    string
+	Href    string
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+	Excerpt string
+}
+
+// excerpt renders the part of a page before the excerpt separator without
+// its headings, or its first paragraph if there's no separator
+func (h *Handler) excerpt(source []byte) string {
+	source = authBlocks(source, false)
+	i := bytes.Index(source, []byte(h.excerptSeparator))
+	if i >= 0 {
+		source = source[:i]
+	}
+	nodes, err := parseContent(h.renderMarkdown(source))
+	if err != nil {
+		return ""
+	}
+	var b bytes.Buffer
+	for _, n := range nodes {
+		if n.Type == html.ElementNode && isHeading(n.Data) {
+			continue
+		}
+		if i >= 0 {
+			html.Render(&b, n)
+		} else if n.Type == html.ElementNode && n.Data == "p" {
+			html.Render(&b, n)
+			break
+		}
+	}
+	return b.String()
+}
+
+// listDir returns the entries of a directory below the base directory,
+// leaving out dotfiles like .auth and .header
+func (s *site) listDir(name string) ([]dirEntry, error) {
+	dir, err := sitePath(name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := fs.ReadDir(s.files, dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []dirEntry
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		// follow symlinks the way serving the entry would
+		file := path.Join(dir, info.Name())
+		info, err := fs.Stat(s.files, file)
+		if err != nil || info.IsDir() && s.inDraft(path.Join(name, info.Name())) {
+			continue
+		}
+		entry := dirEntry{Name: info.Name(), Href: url.PathEscape(info.Name()), Dir: info.IsDir(), Size: info.Size(), ModTime: info.ModTime()}
+		switch ext := path.Ext(entry.Name); {
+		case entry.Dir:
+			entry.Href += "/"
+		case s.isPage(ext):
+			entry.Name = strings.TrimSuffix(entry.Name, ext)
+			// language variants are listed as the page they translate
+			if _, ok := s.stripLanguage(entry.Name); ok {
+				continue
+			}
+			entry.Href = url.PathEscape(entry.Name)
+			data, err := fs.ReadFile(s.files, file)
+			if ext == ".ipynb" && err == nil {
+				data, err = notebook(data)
+			}
+			if s.excerpts && err == nil {
+				_, data = frontmatter(data)
+				entry.Excerpt = s.excerpt(data)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// renderListing renders a page of a directory listing, clamping pageNumber
+// to the pages there are, and returns the links to the adjacent pages
+func (s *site) renderListing(entries []dirEntry, pageNumber int) (content []byte, prev, next string) {
+	pages := (len(entries) + s.listingPageSize - 1) / s.listingPageSize
+	if pageNumber > pages {
+		pageNumber = pages
+	}
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+	start := (pageNumber - 1) * s.listingPageSize
+	end := start + s.listingPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	data := listingData{Page: pageNumber, Pages: pages}
+	for _, entry := range entries[start:end] {
+		data.Entries = append(data.Entries, listingEntry{entry, htmltemplate.HTML(entry.Excerpt)})
+	}
+	if pageNumber > 1 {
+		data.Prev = "?page=" + strconv.Itoa(pageNumber-1)
+	}
+	if pageNumber < pages {
+		data.Next = "?page=" + strconv.Itoa(pageNumber+1)
+	}
+
+	// render with the .listing.html template if there is a valid one
+	tmpl := defaultListing
+	if text, err := s.control.readInclude(".listing.html"); err == nil {
+		custom, err := htmltemplate.New("listing").Parse(string(text))
+		if err == nil {
+			tmpl = custom
+		} else {
+			s.logger.Print(err)
+		}
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		s.logger.Print(err)
+		b.Reset()
+		defaultListing.Execute(&b, data)
+	}
+	return b.Bytes(), data.Prev, data.Next
+}
+
+// listingData is what listing templates are executed with
+type listingData struct {
+	Entries     []listingEntry
+	Page, Pages int
+	Prev, Next  string
+}
+
+type listingEntry struct {
+	dirEntry
+	Excerpt htmltemplate.HTML
+}
+
+// defaultListing renders listings without a .listing.html template
+var defaultListing = htmltemplate.Must(htmltemplate.New("listing").Parse(`<ul class="listing">` +
+	`{{range .Entries}}<li><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a>` +
+	`{{if .Excerpt}}<div class="excerpt">{{.Excerpt}}</div>{{end}}</li>{{end}}</ul>` +
+	`{{if or .Prev .Next}}<nav class="pagination">` +
+	"{{if .Prev}}<a href=\"{{.Prev}}\" rel=\"prev\">\u2190 previous</a> {{end}}" +
+	"{{if .Next}}<a href=\"{{.Next}}\" rel=\"next\">next \u2192</a>{{end}}</nav>{{end}}"))
+
+// tagIndex maps tags to the pages tagged with them
+type tagIndex struct {
+	sync.RWMutex
+	tags map[string][]dirEntry
+	// pages holds what indexTags found in every page by file, so that only
+	// pages that changed are read and rendered again
+	pages map[string]taggedPage
+}
+
+// taggedPage is a page as indexed by indexTags
+type taggedPage struct {
+	modTime time.Time
+	size    int64
+	tags    []string
+	entry   dirEntry
+}
+
+// walkPages calls fn with the name, file and info of every page below the
+// base directory, leaving out dotfiles
+func (s *site) walkPages(fn func(name, file string, info os.FileInfo)) error {
+	return fs.WalkDir(s.files, ".", func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && file != "." || d.IsDir() && s.inDraft(file) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		ext := path.Ext(file)
+		if d.IsDir() || !s.isPage(ext) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		fn("/"+strings.TrimSuffix(file, ext), file, info)
+		return nil
+	})
+}
+
+// parseTags parses a tags frontmatter field like "a, b" or "[a, b]"
+func parseTags(field string) []string {
+	var tags []string
+	for _, tag := range strings.Split(strings.Trim(field, "[]"), ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// indexTags rebuilds tagIndex from the pages below the base directory,
+// reading only the pages whose mtime or size changed since the last time
+func (s *site) indexTags() error {
+	tags := map[string][]dirEntry{}
+	pages := map[string]taggedPage{}
+	err := s.walkPages(func(page, file string, info os.FileInfo) {
+		if _, ok := s.stripLanguage(page); ok {
+			return
+		}
+		indexed, ok := s.tags.pages[file]
+		if !ok || !indexed.modTime.Equal(info.ModTime()) || indexed.size != info.Size() {
+			indexed = s.indexPage(page, file, info)
+		}
+		pages[file] = indexed
+		for _, tag := range indexed.tags {
+			tags[tag] = append(tags[tag], indexed.entry)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, entries := range tags {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+	s.tags.Lock()
+	s.tags.tags = tags
+	s.tags.pages = pages
+	s.tags.Unlock()
+	return nil
+}
+
+// indexPage reads the tags of a page and its listing entry
+func (s *site) indexPage(page, file string, info os.FileInfo) taggedPage {
+	indexed := taggedPage{modTime: info.ModTime(), size: info.Size()}
+	data, err := fs.ReadFile(s.files, file)
+	if err != nil {
+		return indexed
+	}
+	meta, data := frontmatter(s.decode(page, data))
+	indexed.tags = parseTags(meta["tags"])
+	if len(indexed.tags) == 0 {
+		return indexed
+	}
+	urlPath := page
+	if path.Base(urlPath) == "index" {
+		urlPath = strings.TrimSuffix(urlPath, "index")
+	}
+	name := strings.TrimPrefix(urlPath, "/")
+	if content, err := parseContent(s.renderMarkdown(authBlocks(data, false))); err == nil {
+		if heading := firstHeading(content); heading != "" {
+			name = heading
+		}
+	}
+	indexed.entry = dirEntry{Name: name, Href: (&url.URL{Path: urlPath}).String(), Size: info.Size(), ModTime: info.ModTime()}
+	if s.excerpts {
+		indexed.entry.Excerpt = s.excerpt(data)
+	}
+	return indexed
+}
+
+// tagEntries returns a heading and the entries of the listing of a tag, or
+// of all tags if tag is empty
+func (s *site) tagEntries(tag string) (string, []dirEntry, error) {
+	s.tags.RLock()
+	defer s.tags.RUnlock()
+	if tag == "" {
+		var entries []dirEntry
+		for tag, pages := range s.tags.tags {
+			entries = append(entries, dirEntry{Name: tag + " (" + strconv.Itoa(len(pages)) + ")", Href: url.PathEscape(tag) + "/"})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		return "Tags", entries, nil
+	}
+	entries, ok := s.tags.tags[strings.ToLower(tag)]
+	if !ok {
+		return "", nil, errors.New("tag " + tag + ": no pages")
+	}
+	return "Tagged \u201c" + tag + "\u201d", entries, nil
+}
+
+// headerData is what placeholders in the header include expand to
+type headerData struct {
+	Title       string
+	Breadcrumbs string
+	Path        string
+	Year        int
+}
+
+// expandHeader fills in the {{title}}, {{breadcrumbs}}, {{path}} and {{year}}
+// placeholders of the header include, leaving it as is when it isn't a valid
+// template, and reports whether it has a title element and the breadcrumbs
+// were placed
+func expandHeader(header []byte, title, breadcrumbs, urlPath string) ([]byte, bool, bool) {
+	data := headerData{html.EscapeString(title), breadcrumbs, html.EscapeString(urlPath), time.Now().Year()}
+	placedBreadcrumbs := false
+	t, err := template.New(".header").Funcs(template.FuncMap{
+		"title": func() string { return data.Title },
+		"breadcrumbs": func() string {
+			placedBreadcrumbs = true
+			return data.Breadcrumbs
+		},
+		"path": func() string { return data.Path },
+		"year": func() int { return data.Year },
+	}).Parse(string(header))
+	if err != nil {
+		return header, hasTitle(header), false
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return header, hasTitle(header), false
+	}
+	return b.Bytes(), hasTitle(b.Bytes()), placedBreadcrumbs
+}
+
+// hasTitle reports whether there is a title element in header, which may
+// use {{title}} elsewhere, like in a heading
+func hasTitle(header []byte) bool {
+	z := html.NewTokenizer(bytes.NewReader(header))
+	for {
+		switch tt := z.Next(); tt {
+		case html.ErrorToken:
+			return false
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == "title" {
+				return true
+			}
+		}
+	}
+}
+
+// exists reports whether there's a page, static file or directory listing
+// at name
+func (s *site) exists(name string) bool {
+	if s.inDraft(name) {
+		return false
+	}
+	// stat the page instead of reading it, which would run the converter
+	// of .adoc and .rst pages
+	for _, page := range []string{name, path.Join(name, "index")} {
+		if info, err := s.readInfo(page); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	if s.tagPages && (name == "/tags" || strings.HasPrefix(name, "/tags/")) {
+		_, _, err := s.tagEntries(strings.Trim(strings.TrimPrefix(name, "/tags"), "/"))
+		return err == nil
+	}
+	if s.listed(name) {
+		info, err := s.readInfo(name)
+		return err == nil && info.IsDir()
+	}
+	return false
+}
+
+// matchCase returns urlPath in the case of the page, file or directory it
+// names when ignoring case, if there is one and -fold-case is on
+func (s *site) matchCase(urlPath string) (string, bool) {
+	if !s.foldCase {
+		return "", false
+	}
+	name, err := sitePath(urlPath)
+	if err != nil || name == "." {
+		return "", false
+	}
+	parts := strings.Split(name, "/")
+	matched := "."
+	for i, part := range parts {
+		entries, err := fs.ReadDir(s.files, matched)
+		if err != nil {
+			return "", false
+		}
+		found := ""
+		for _, entry := range entries {
+			name := entry.Name()
+			if ext := path.Ext(name); i == len(parts)-1 && !entry.IsDir() && s.isPage(ext) && strings.EqualFold(strings.TrimSuffix(name, ext), part) {
+				name = strings.TrimSuffix(name, ext)
+			}
+			if strings.HasPrefix(name, ".") || !strings.EqualFold(name, part) {
+				continue
+			}
+			if found = name; name == part {
+				break
+			}
+		}
+		if found == "" {
+			return "", false
+		}
+		matched = path.Join(matched, found)
+	}
+	matched = "/" + matched
+	if s.inDraft(matched) {
+		return "", false
+	}
+	if strings.HasSuffix(urlPath, "/") {
+		matched += "/"
+	}
+	return matched, matched != urlPath
+}
+
+// inDraft reports whether name is in a directory marked as a draft by a
+// .draft file, or is one, unless -drafts
+func (s *site) inDraft(name string) bool {
+	if s.drafts {
+		return false
+	}
+	for dir := path.Clean("/" + name); ; dir = path.Dir(dir) {
+		if _, err := s.stat(path.Join(dir, ".draft")); err == nil {
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
+
+// hidden reports whether urlPath has a segment starting with a dot, like
+// the control files .auth and .header, which are never served, except for
+// .well-known
+func hidden(urlPath string) bool {
+	for _, segment := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
+
+// listed reports whether the directory at urlPath gets a listing when it
+// has no index
+func (h *Handler) listed(urlPath string) bool {
+	return h.dirListing && (h.listingScope == "all" || path.Clean(urlPath) == "/")
+}
+
+// linkTarget resolves the path of a link on page to a path below the base
+// directory. The query and fragment don't take part in resolution, and a link
+// without a path refers to the current page.
+func linkTarget(page, linkPath string) string {
+	if linkPath == "" {
+		return page
+	}
+	if strings.HasPrefix(linkPath, "/") {
+		return linkPath
+	}
+	return path.Join(path.Dir(page), linkPath)
+}
+
+// imageSize reads the dimensions of a local image, skipping ones larger
+// than -img-max-size
+func (s *site) imageSize(name string) (int, int, error) {
+	file, err := sitePath(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := s.files.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.Size() > s.imgMaxSize {
+		return 0, 0, errors.New(file + ": too large to read dimensions from")
+	}
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// readSmall reads a local asset if it's no larger than -inline-max-size,
+// leaving out dotfiles and drafts as serving it would
+func (s *site) readSmall(name string) ([]byte, bool) {
+	if hidden(name) || s.inDraft(name) {
+		return nil, false
+	}
+	info, err := s.stat(name)
+	if err != nil || info.IsDir() || info.Size() > s.inlineMaxSize {
+		return nil, false
+	}
+	data, err := s.read(name)
+	return data, err == nil
+}
+
+// localPath returns the path of a URL pointing at this site
+func localPath(ref string) (string, bool) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+func addClass(n *html.Node, class string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == "class" {
+			n.Attr[i].Val = n.Attr[i].Val + " " + class
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "class", Val: class})
+}
+
+// addRel adds link types to the rel attribute, skipping ones already present
+func addRel(n *html.Node, rels ...string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == "rel" {
+			existing := strings.Fields(n.Attr[i].Val)
+		outer:
+			for _, rel := range rels {
+				for _, e := range existing {
+					if strings.EqualFold(e, rel) {
+						continue outer
+					}
+				}
+				existing = append(existing, rel)
+			}
+			n.Attr[i].Val = strings.Join(existing, " ")
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "rel", Val: strings.Join(rels, " ")})
+}
+
+// matchHost reports whether host is one of hosts or a subdomain of one
+func matchHost(host string, hosts []string) bool {
+	host = strings.ToLower(host)
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) isLanguage(lang string) bool {
+	for _, l := range h.languages {
+		if lang == l {
+			return true
+		}
+	}
+	return false
+}
+
+// stripLanguage returns the page name like page for a variant of it in a
+// language of -languages like page.fr, reporting whether it was one
+func (h *Handler) stripLanguage(name string) (string, bool) {
+	ext := path.Ext(name)
+	if ext == "" || !h.isLanguage(ext[1:]) {
+		return name, false
+	}
+	return strings.TrimSuffix(name, ext), true
+}
+
+// pageLanguage returns the language of -languages asked for by the lang
+// query parameter, or else the one Accept-Language prefers, if any
+func (h *Handler) pageLanguage(r *http.Request) string {
+	if lang := strings.ToLower(r.URL.Query().Get("lang")); h.isLanguage(lang) {
+		return lang
+	}
+	best, bestQ := "", 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		params := strings.Split(accepted, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		for _, lang := range h.languages {
+			if q > bestQ && (tag == lang || strings.HasPrefix(tag, lang+"-")) {
+				best, bestQ = lang, q
+			}
+		}
+	}
+	return best
+}
+
+// vary adds the comma-separated fields to the Vary header of the response,
+// keeping it a single comma-separated list without duplicates
+func vary(w http.ResponseWriter, fields string) {
+	var list []string
+	seen := map[string]bool{}
+	for _, value := range append(w.Header().Values("Vary"), fields) {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			key := strings.ToLower(field)
+			if field == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			list = append(list, field)
+		}
+	}
+	w.Header().Set("Vary", strings.Join(list, ", "))
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r allows
+// the content coding
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(accepted, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), coding) {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if param == "q=0" || strings.HasPrefix(param, "q=0.") && strings.Trim(param[4:], "0") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// keepLastAttr drops all but the last of repeated key attributes, like an
+// auto-generated heading id followed by one given with {#id}
+func keepLastAttr(n *html.Node, key string) {
+	last := -1
+	for i, attr := range n.Attr {
+		if attr.Key == key {
+			last = i
+		}
+	}
+	attrs := n.Attr[:0]
+	for i, attr := range n.Attr {
+		if attr.Key != key || i == last {
+			attrs = append(attrs, attr)
+		}
+	}
+	n.Attr = attrs
+}
+
+func getAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// validToken reports whether token is one of the lines of the .auth file.
+// Listing the previous token after the current one keeps sessions using it
+// valid while the secret is rotated; removing it ends them.
+func validToken(auth []byte, token string) bool {
+	valid := false
+	for _, line := range strings.Split(string(auth), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && subtle.ConstantTimeCompare([]byte(line), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// newMinifier returns a minifier for the enabled content types
+func (h *Handler) newMinifier() *minify.M {
+	m := minify.New()
+	if h.minifiers["html"] {
+		m.AddFunc("text/html", mhtml.Minify)
+	}
+	if h.minifiers["css"] {
+		m.AddFunc("text/css", css.Minify)
+	}
+	if h.minifiers["js"] {
+		m.AddFuncRegexp(regexp.MustCompile("^(application|text)/(x-)?(java|ecma)script$"), js.Minify)
+	}
+	if h.minifiers["svg"] {
+		m.AddFunc("image/svg+xml", svg.Minify)
+	}
+	if h.minifiers["json"] {
+		m.AddFuncRegexp(regexp.MustCompile("[/+]json$"), json.Minify)
+	}
+	// invalid JSON-LD would otherwise fail the minification of the whole page
+	m.AddFunc("application/ld+json", func(m *minify.M, w io.Writer, r io.Reader, params map[string]string) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		var minified bytes.Buffer
+		if h.jsonLD == "minify" && h.minifiers["json"] && json.Minify(m, &minified, bytes.NewReader(data), params) == nil {
+			data = minified.Bytes()
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if h.minifiers["xml"] {
+		m.AddFuncRegexp(regexp.MustCompile("[/+]xml$"), xml.Minify)
+	}
+	return m
+}
+
+// serveStatic serves the file name, preferring precompressed
+// sidecars and minifying it otherwise
+func (s *site) serveStatic(w http.ResponseWriter, r *http.Request, name string, m *minify.M) {
+	file, err := s.read(name)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// the source of a page with auth blocks would give them away, including
+	// its precompressed sidecars, so it is missing for visitors not logged in
+	if s.isPage(path.Ext(name)) && s.hasAuth() && bytes.Contains(file, []byte("{{#auth}}")) && !s.loggedIn(r) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(404)
+		w.Write([]byte((&fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}).Error()))
+		return
+	}
+	// the query is only looked at for caching, a versioned URL changes with
+	// the file
+	if s.versionParam != "" && r.URL.Query().Get(s.versionParam) != "" {
+		w.Header().Set("Cache-Control", s.versionedHeader)
+	} else {
+		w.Header().Set("Cache-Control", s.staticCacheHeader)
+	}
+	contentType := typeByExtension(path.Ext(name))
+	if contentType == "" && s.sniff {
+		contentType = http.DetectContentType(file)
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	// serve a precompressed sidecar if the client names its coding, zstd
+	// first
+	vary(w, "Accept-Encoding")
+	for _, sidecar := range []struct{ ext, encoding string }{{".zst", "zstd"}, {".br", "br"}, {".gz", "gzip"}} {
+		if !acceptsEncoding(r, sidecar.encoding) {
+			continue
+		}
+		compressed, err := s.read(name + sidecar.ext)
+		if err == nil {
+			w.Header().Set("Content-Encoding", sidecar.encoding)
+			w.Write(compressed)
+			return
+		}
+	}
+
+	// serve types without a minifier as is
+	if _, _, minifier := m.Match(contentType); minifier == nil {
+		w.Write(file)
+		return
+	}
+	b, err := m.Bytes(contentType, file)
+	if err != nil {
+		w.Write(file)
+		return
+	}
+	w.Write(b)
+}
+
+// isTagPath reports whether urlPath is below /tags
+func isTagPath(urlPath string) bool {
+	return urlPath == "/tags" || strings.HasPrefix(urlPath, "/tags/")
+}
+
+// renderIndex renders the tag page or directory listing standing in for the
+// missing page at urlPath, with links to the previous and next listing pages
+func (s *site) renderIndex(urlPath string, pageNumber int) (listing []byte, prev, next string, err error) {
+	if s.tagPages && isTagPath(urlPath) {
+		heading, entries, err := s.tagEntries(strings.Trim(strings.TrimPrefix(urlPath, "/tags"), "/"))
+		if err != nil {
+			return nil, "", "", err
+		}
+		listing, prev, next = s.renderListing(entries, pageNumber)
+		return append([]byte("<h1>"+html.EscapeString(heading)+"</h1>"), listing...), prev, next, nil
+	}
+	entries, err := s.listDir(urlPath)
+	if err != nil {
+		return nil, "", "", err
+	}
+	listing, prev, next = s.renderListing(entries, pageNumber)
+	return listing, prev, next, nil
+}
+
+// pageTitle builds the title of the page at urlPath
+func (h *Handler) pageTitle(content []*html.Node, urlPath string) string {
+	// the heading is taken from the content only, as one in the header
+	// would be the same on every page
+	page := firstHeading(content)
+	if page == "" {
+		page = strings.TrimPrefix(urlPath, "/")
+	}
+	if h.titleFormat != "" {
+		return strings.Replace(strings.Replace(h.titleFormat, "{{page}}", page, -1), "{{site}}", h.siteName, -1)
+	}
+	if h.noBranding {
+		if page == "" {
+			return h.unbrandedHome
+		}
+		return page
+	}
+	if page == "" {
+		return h.siteName + "!"
+	}
+	return h.siteName + ": " + page
+}
+
+// upLink returns the link to the parent of the page at urlPath
+func upLink(urlPath string) string {
+	if urlPath == "/" {
+		return ""
+	}
+	var up string
+	if strings.HasSuffix(urlPath, "/") {
+		up = ".."
+	} else {
+		up = path.Join("..", path.Base(path.Join(urlPath, ".."))) + "/"
+	}
+	return "<a href=\"" + up + "\" class=\"up-arrow\">\u21b0 up</a>"
+}
+
+// neighbours returns the names of the pages before and after the page name
+// in its directory with -page-nav, empty at either end
+func (s *site) neighbours(name string) (prev, next string) {
+	dir, base := path.Split(name)
+	var names []string
+	if s.pageNav == "order" {
+		order, err := s.read(path.Join(dir, ".order"))
+		if err != nil {
+			return "", ""
+		}
+		for _, line := range strings.Split(string(order), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				names = append(names, strings.TrimSuffix(line, path.Ext(line)))
+			}
+		}
+	} else {
+		file, err := sitePath(dir)
+		if err != nil {
+			return "", ""
+		}
+		entries, err := fs.ReadDir(s.files, file)
+		if err != nil {
+			return "", ""
+		}
+		for _, entry := range entries {
+			ext := path.Ext(entry.Name())
+			page := strings.TrimSuffix(entry.Name(), ext)
+			if _, variant := s.stripLanguage(page); entry.IsDir() || !s.isPage(ext) || strings.HasPrefix(page, ".") || page == "index" || variant || len(names) > 0 && names[len(names)-1] == page {
+				continue
+			}
+			names = append(names, page)
+		}
+		sort.Strings(names)
+	}
+	for i, page := range names {
+		if page != base {
+			continue
+		}
+		if i > 0 {
+			prev = names[i-1]
+		}
+		if i < len(names)-1 {
+			next = names[i+1]
+		}
+		break
+	}
+	return prev, next
+}
+
+// pageNavLinks links the previous and next page for -page-nav
+func pageNavLinks(prev, next string) string {
+	var links []string
+	if prev != "" {
+		links = append(links, "<a href=\""+html.EscapeString(url.PathEscape(prev))+"\" rel=\"prev\">\u2190 "+html.EscapeString(prev)+"</a>")
+	}
+	if next != "" {
+		links = append(links, "<a href=\""+html.EscapeString(url.PathEscape(next))+"\" rel=\"next\">"+html.EscapeString(next)+" \u2192</a>")
+	}
+	if links == nil {
+		return ""
+	}
+	return "<nav class=\"page-nav\">" + strings.Join(links, " ") + "</nav>"
+}
+
+// editLink links to the source file name in the repository of -edit-url
+func (h *Handler) editLink(name string) string {
+	href := strings.Replace(h.editURL, "{path}", (&url.URL{Path: strings.TrimPrefix(name, "/")}).EscapedPath(), -1)
+	return "<a href=\"" + html.EscapeString(href) + "\" class=\"edit-page\">Edit this page</a>"
+}
+
+// assemble joins the header, title, up link and content of a page
+func (s *site) assemble(title, breadcrumbs, urlPath string, md []byte) []byte {
+	var rawDoc []byte
+
+	// add header, which may place the title and up link itself
+	placedTitle, placedBreadcrumbs := false, false
+	header, err := s.control.readInclude(".header")
+	if err == nil {
+		header, placedTitle, placedBreadcrumbs = expandHeader(header, title, breadcrumbs, urlPath)
+		rawDoc = append(rawDoc, header...)
+	}
+
+	// add title
+	if !placedTitle {
+		rawDoc = append(rawDoc, []byte("<title>"+html.EscapeString(title)+"</title>\n")...)
+	}
+
+	// add up link
+	if !placedBreadcrumbs {
+		rawDoc = append(rawDoc, []byte(breadcrumbs)...)
+	}
+
+	// add sidebar
+	if nav, err := s.control.readInclude(".nav"); err == nil {
+		rawDoc = append(rawDoc, "<nav class=\"site-nav\">"...)
+		rawDoc = append(rawDoc, s.renderMarkdown(nav)...)
+		rawDoc = append(rawDoc, "</nav>\n"...)
+	}
+
+	// add content
+	return append(rawDoc, md...)
+}
+
+// inlineStylesheet replaces the stylesheet link n on the page urlPath with
+// a style element if the stylesheet is small enough
+func (s *site) inlineStylesheet(n *html.Node, urlPath string) {
+	// stylesheets with url()s are left alone as their relative references
+	// would break
+	if ref, ok := localPath(getAttr(n, "href")); ok && s.inlineMaxSize > 0 {
+		if data, ok := s.readSmall(linkTarget(urlPath, ref)); ok && !bytes.Contains(data, []byte("url(")) {
+			attrs := []html.Attribute{}
+			if media := getAttr(n, "media"); media != "" {
+				attrs = append(attrs, html.Attribute{Key: "media", Val: media})
+			}
+			n.Data, n.DataAtom, n.Attr = "style", atom.Style, attrs
+			n.AppendChild(&html.Node{Type: html.TextNode, Data: string(data)})
+		}
+	}
+}
+
+// annotateImage adds dimensions to the image n on the page urlPath and
+// inlines it if it is small enough
+func (s *site) annotateImage(n *html.Node, urlPath string) {
+	ref, local := localPath(getAttr(n, "src"))
+	if local && s.imgDimensions && !hasAttr(n, "width") && !hasAttr(n, "height") {
+		width, height, err := s.imageSize(linkTarget(urlPath, ref))
+		if err == nil {
+			n.Attr = append(n.Attr, html.Attribute{Key: "width", Val: strconv.Itoa(width)}, html.Attribute{Key: "height", Val: strconv.Itoa(height)})
+		}
+	}
+	if contentType := typeByExtension(path.Ext(ref)); local && s.inlineMaxSize > 0 && contentType != "" {
+		if data, ok := s.readSmall(linkTarget(urlPath, ref)); ok {
+			for i := range n.Attr {
+				if n.Attr[i].Key == "src" {
+					n.Attr[i].Val = "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+				}
+			}
+		}
+	}
+}
+
+// annotateLink marks up the link n on the page urlPath as broken or
+// external and points it at clean URLs, returning its href if it is broken
+func (s *site) annotateLink(n *html.Node, urlPath string) (string, bool) {
+	broken := false
+	external := false
+	var href, host string
+	for i, attr := range n.Attr {
+		if attr.Key == "href" {
+			href = attr.Val
+			link, err := url.Parse(attr.Val)
+			if err != nil {
+				broken = true
+				break
+			}
+			if len(link.Host) > 0 {
+				external = true
+				host = link.Hostname()
+				break
+			}
+			target := linkTarget(urlPath, link.Path)
+			if !s.exists(target) {
+				broken = true
+				break
+			}
+			// point at the clean URL instead of the source file
+			if ext := path.Ext(link.Path); s.isPage(ext) {
+				link.Path = strings.TrimSuffix(link.Path, ext)
+				if path.Base(link.Path) == "index" {
+					link.Path = strings.TrimSuffix(link.Path, "index")
+					if link.Path == "" {
+						link.Path = "./"
+					}
+				}
+				link.RawPath = ""
+				n.Attr[i].Val = link.String()
+			}
+		}
+	}
+	if broken {
+		addClass(n, s.brokenLinkClass)
+	}
+	if external {
+		addClass(n, s.externalLinkClass)
+		if s.externalNewTab && !matchHost(host, s.sameTabHosts) {
+			if !hasAttr(n, "target") {
+				n.Attr = append(n.Attr, html.Attribute{Key: "target", Val: "_blank"})
+			}
+			addRel(n, "noopener", "noreferrer")
+		}
+		if s.nofollow && !matchHost(host, s.followHosts) {
+			addRel(n, "nofollow")
+		}
+		if s.externalLinkIcon && !hasImage(n) {
+			icon := &html.Node{Type: html.ElementNode, Data: "span", Attr: []html.Attribute{{Key: "class", Val: s.externalLinkClass + "-icon"}, {Key: "aria-hidden", Val: "true"}}}
+			icon.AppendChild(&html.Node{Type: html.TextNode, Data: "\u2197"})
+			n.AppendChild(icon)
+		}
+	}
+	return href, broken
+}
+
+// hasImage reports whether there is an image below n
+func hasImage(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (c.Data == "img" || c.Data == "svg" || c.Data == "picture") || hasImage(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// annotate annotates the page doc with the content rendered from source at
+// urlPath, links the listing pages prev and next and adds the site-wide
+// stylesheets and scripts, returning the broken links
+func (s *site) annotate(doc *html.Node, content []*html.Node, urlPath, source string, meta map[string]string, prev, next string) []string {
+	var brokenLinks []string
+	var f func(*html.Node)
+	pageDir := s.dir
+	if d := meta["dir"]; d == "ltr" || d == "rtl" || d == "auto" {
+		pageDir = d
+	}
+	pageKind := "subpage"
+	if urlPath == "/" {
+		pageKind = "home"
+	} else if strings.HasSuffix(urlPath, "/") {
+		pageKind = "dir-index"
+	}
+	var head, body *html.Node
+	included := map[string]bool{}
+	credited := false
+	minutes := (wordCount(content) + s.wordsPerMinute - 1) / s.wordsPerMinute
+	if minutes < 1 {
+		minutes = 1
+	}
+	var lastmod string
+	if info, err := s.readInfo(source); err == nil {
+		lastmod = info.ModTime().In(s.lastmodLocation).Format(s.lastmodFormat)
+	}
+	f = func(n *html.Node) {
+		if n.Type == html.TextNode && !inCode(n) {
+			n.Data = strings.Replace(n.Data, "[[readingtime]]", strconv.Itoa(minutes)+" min", -1)
+			n.Data = strings.Replace(n.Data, "[[lastmod]]", lastmod, -1)
+		}
+		if n.Type == html.ElementNode && n.Data == "head" {
+			head = n
+		}
+		if n.Type == html.ElementNode && n.Data == "body" {
+			body = n
+			addClass(n, "page "+pageKind)
+		}
+		if n.Type == html.ElementNode && n.Data == "link" && strings.EqualFold(getAttr(n, "rel"), "stylesheet") {
+			included["css "+getAttr(n, "href")] = true
+			s.inlineStylesheet(n, urlPath)
+		}
+		if n.Type == html.ElementNode && n.Data == "script" && hasAttr(n, "src") {
+			included["js "+getAttr(n, "src")] = true
+		}
+		if n.Type == html.ElementNode && isHeading(n.Data) {
+			keepLastAttr(n, "id")
+			if s.scrollMargin != "" && getAttr(n, "id") != "" {
+				addClass(n, s.scrollClass)
+			}
+		}
+		if n.Type == html.ElementNode && n.Data == "dl" && s.dlClass != "" {
+			addClass(n, s.dlClass)
+		}
+		if n.Type == html.ElementNode && n.Data == "html" && pageDir != "ltr" && !hasAttr(n, "dir") {
+			n.Attr = append(n.Attr, html.Attribute{Key: "dir", Val: pageDir})
+		}
+		if n.Type == html.ElementNode && n.Data == "img" {
+			s.annotateImage(n, urlPath)
+		}
+		if n.Type == html.ElementNode && strings.Contains(" "+getAttr(n, "class")+" ", " powered-by ") {
+			credited = true
+		}
+		if n.Type == html.ElementNode && n.Data == "nav" && getAttr(n, "class") == "site-nav" {
+			s.markCurrent(n, urlPath)
+		}
+		if n.Type == html.ElementNode && n.Data == "a" {
+			if href, broken := s.annotateLink(n, urlPath); broken {
+				brokenLinks = append(brokenLinks, href)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+
+	// link listing pages
+	for _, link := range []struct{ rel, href string }{{"prev", prev}, {"next", next}} {
+		if link.href != "" {
+			head.AppendChild(&html.Node{Type: html.ElementNode, Data: "link", Attr: []html.Attribute{{Key: "rel", Val: link.rel}, {Key: "href", Val: link.href}}})
+		}
+	}
+
+	// offset anchors by a stylesheet, which unlike style attributes a CSP
+	// nonce covers
+	if s.scrollMargin != "" {
+		style := &html.Node{Type: html.ElementNode, Data: "style"}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: "." + s.scrollClass + "{scroll-margin-top:" + s.scrollMargin + "}"})
+		head.AppendChild(style)
+	}
+
+	// credit nerka
+	if s.poweredBy && !credited {
+		link := &html.Node{Type: html.ElementNode, Data: "a", Attr: []html.Attribute{{Key: "href", Val: "https://github.com/k2l8m11n2/nerka"}}}
+		link.AppendChild(&html.Node{Type: html.TextNode, Data: "nerka"})
+		footer := &html.Node{Type: html.ElementNode, Data: "footer", Attr: []html.Attribute{{Key: "class", Val: "powered-by"}}}
+		footer.AppendChild(&html.Node{Type: html.TextNode, Data: "Powered by "})
+		footer.AppendChild(link)
+		body.AppendChild(footer)
+	}
+
+	// add site-wide stylesheets and scripts
+	for _, href := range s.stylesheets {
+		if !included["css "+href] {
+			head.AppendChild(&html.Node{Type: html.ElementNode, Data: "link", Attr: []html.Attribute{{Key: "rel", Val: "stylesheet"}, {Key: "href", Val: href}}})
+			included["css "+href] = true
+		}
+	}
+	for _, src := range s.scripts {
+		if !included["js "+src] {
+			body.AppendChild(&html.Node{Type: html.ElementNode, Data: "script", Attr: []html.Attribute{{Key: "src", Val: src}}})
+			included["js "+src] = true
+		}
+	}
+	return brokenLinks
+}
+
+// markCurrent marks the links to urlPath below n as the current page,
+// before their hrefs are cleaned up
+func (h *Handler) markCurrent(n *html.Node, urlPath string) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		h.markCurrent(c, urlPath)
+		if c.Type != html.ElementNode || c.Data != "a" {
+			continue
+		}
+		link, err := url.Parse(getAttr(c, "href"))
+		if err != nil || link.Host != "" || link.Path == "" {
+			continue
+		}
+		target := linkTarget(urlPath, link.Path)
+		if ext := path.Ext(target); h.isPage(ext) {
+			target = strings.TrimSuffix(target, ext)
+		}
+		if path.Base(target) == "index" {
+			target = strings.TrimSuffix(target, "index")
+		}
+		if target == urlPath {
+			addClass(c, "active")
+			c.Attr = append(c.Attr, html.Attribute{Key: "aria-current", Val: "page"})
+		}
+	}
+}
+
+// placeholder stands in for the i-th verbatim block, in characters that
+// neither the minifier nor the rewrites touch
+func placeholder(i int) string {
+	return "\ue000" + strconv.Itoa(i) + "\ue001"
+}
+
+// verbatim replaces the elements marked data-no-minify below n with
+// placeholders and returns their rendered HTML. Their text, attribute
+// values and script contents stay as written, while the markup around
+// them is normalized by rendering, like quoting attributes.
+func verbatim(n *html.Node) [][]byte {
+	var marked []*html.Node
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && hasAttr(n, "data-no-minify") {
+			marked = append(marked, n)
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(n)
+	var blocks [][]byte
+	for i, n := range marked {
+		var block bytes.Buffer
+		html.Render(&block, n)
+		blocks = append(blocks, block.Bytes())
+		n.Parent.InsertBefore(&html.Node{Type: html.TextNode, Data: placeholder(i)}, n)
+		n.Parent.RemoveChild(n)
+	}
+	return blocks
+}
+
+// addNonce sets the nonce of the script and style elements below n
+func addNonce(n *html.Node, nonce string) {
+	if n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style") {
+		attrs := n.Attr[:0]
+		for _, attr := range n.Attr {
+			if attr.Key != "nonce" {
+				attrs = append(attrs, attr)
+			}
+		}
+		n.Attr = append(attrs, html.Attribute{Key: "nonce", Val: nonce})
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		addNonce(c, nonce)
+	}
+}
+
+// reportBrokenLinks logs the broken links of the page at urlPath and lists
+// them in a header with -broken-links-header
+func (h *Handler) reportBrokenLinks(w http.ResponseWriter, urlPath string, brokenLinks []string) {
+	for _, link := range brokenLinks {
+		h.debugf("%s: broken link to %s", urlPath, link)
+	}
+	if h.brokenLinksHeader && len(brokenLinks) > 0 {
+		report := strings.Join(brokenLinks, ", ")
+		if len(report) > maxBrokenLinksHeader {
+			// cut between characters, keeping the header valid UTF-8
+			end := maxBrokenLinksHeader - 3
+			for end > 0 && !utf8.RuneStart(report[end]) {
+				end--
+			}
+			report = report[:end] + "..."
+		}
+		w.Header().Set("X-Broken-Links", report)
+	}
+}
+
+// allowMethod answers OPTIONS requests and those with a method missing from
+// allowed, a list like "GET, HEAD", reporting whether the request is left
+// to serve
+func allowMethod(w http.ResponseWriter, r *http.Request, allowed string) bool {
+	allowed += ", OPTIONS"
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", allowed)
+		w.WriteHeader(204)
+		return false
+	}
+	for _, method := range strings.Split(allowed, ", ") {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", allowed)
+	w.WriteHeader(405)
+	w.Write([]byte("method not allowed"))
+	return false
+}
+
+// hasAuth reports whether the site has a .auth file or -auth-token is given
+func (s *site) hasAuth() bool {
+	_, err := s.control.stat(".auth")
+	return err == nil || len(s.authTokens) > 0
+}
+
+// loggedIn reports whether the request carries a token listed in .auth or
+// given with -auth-token, which it can't without either
+func (s *site) loggedIn(r *http.Request) bool {
+	auth, err := s.control.read(".auth")
+	if err != nil && len(s.authTokens) == 0 {
+		return false
+	}
+	auth = append(auth, "\n"+strings.Join(s.authTokens, "\n")...)
+	cookie, err := r.Cookie(s.authCookie)
+	return err == nil && validToken(auth, cookie.Value)
+}
+
+// authorized reports whether the request is served: without auth, when it
+// is logged in, or with -auth-optional
+func (s *site) authorized(r *http.Request) bool {
+	return !s.hasAuth() || s.authOptional || s.loggedIn(r)
+}
+
+// authBlocks keeps the contents of the {{#auth}}...{{/auth}} blocks of a
+// page for logged in visitors and leaves them out for others, a block
+// without an end running to the end of the page
+func authBlocks(page []byte, loggedIn bool) []byte {
+	start, end := []byte("{{#auth}}"), []byte("{{/auth}}")
+	var out []byte
+	for {
+		i := bytes.Index(page, start)
+		if i < 0 {
+			return append(out, page...)
+		}
+		out = append(out, page[:i]...)
+		block := page[i+len(start):]
+		page = nil
+		if j := bytes.Index(block, end); j >= 0 {
+			block, page = block[:j], block[j+len(end):]
+		}
+		if loggedIn {
+			out = append(out, block...)
+		}
+	}
+}
+
+// serveEvents streams the lines appended to -events-file as server-sent
+// events, or pings if there is none, checking every -events-interval
+func (h *Handler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if !allowMethod(w, r, "GET, HEAD") {
+		return
+	}
+	if !h.siteFor(r.Host).authorized(r) {
+		w.WriteHeader(403)
+		w.Write([]byte("no"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Write([]byte("streaming unsupported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(200)
+	if r.Method == "HEAD" {
+		return
+	}
+	flusher.Flush()
+
+	// only lines appended from now on are sent
+	var offset int64
+	if info, err := os.Stat(h.eventsFile); h.eventsFile != "" && err == nil {
+		offset = info.Size()
+	}
+	ticker := time.NewTicker(h.eventsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.stopping:
+			return
+		case <-ticker.C:
+		}
+		var events []byte
+		if h.eventsFile == "" {
+			events = []byte("event: ping\ndata:\n\n")
+		} else {
+			var lines []string
+			lines, offset = tail(h.eventsFile, offset)
+			for _, line := range lines {
+				events = append(events, "data: "+line+"\n\n"...)
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+		if _, err := w.Write(events); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// tail returns the complete lines of the file past offset and the offset
+// after them, starting over if the file was truncated
+func tail(file string, offset int64) ([]string, int64) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, offset
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, offset
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	n, _ := f.ReadAt(data, offset)
+	data = data[:n]
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return nil, offset
+	}
+	lines := strings.Split(string(data[:end]), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines, offset + int64(end) + 1
+}
+
+func (h *Handler) handle(w http.ResponseWriter, r *http.Request) {
+	// redirect to the canonical host, over HTTPS as the cookies are secure
+	// there
+	if h.canonicalHost != "" && !strings.EqualFold(r.Host, h.canonicalHost) {
+		w.Header().Set("Location", "https://"+h.canonicalHost+r.URL.RequestURI())
+		w.WriteHeader(301)
+		return
+	}
+	s := h.siteFor(r.Host)
+
+	// responses only depend on the auth cookie when there is auth
+	if s.hasAuth() {
+		vary(w, "Cookie")
+	}
+	// set auth cookie, also from forms
+	if strings.HasPrefix(r.URL.Path, "/.auth/") {
+		if !allowMethod(w, r, "GET, HEAD, POST") {
+			return
+		}
+		auth := strings.TrimPrefix(r.URL.Path, "/.auth/")
+		secure := r.TLS != nil || h.secureCookies == "always"
+		http.SetCookie(w, &http.Cookie{Name: h.authCookie, Value: auth, Path: "/", Secure: secure, HttpOnly: true, MaxAge: int(h.authMaxAge.Seconds())})
+		w.Header().Set("Location", "..")
+		w.WriteHeader(303)
+		return
+	}
+
+	// only reading methods are served
+	if !allowMethod(w, r, "GET, HEAD") {
+		return
+	}
+
+	// check auth cookie
+	if !s.authorized(r) {
+		// not cached so that logging in takes effect immediately
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(403)
+		w.Write([]byte("no"))
+		return
+	}
+
+	// hide dotfiles and drafts as if they weren't there, before any redirect
+	// gives them away
+	target, ok := h.aliases[r.URL.Path]
+	if !ok {
+		target = r.URL.Path
+	}
+	if hidden(target) || s.inDraft(target) {
+		w.Write([]byte((&fs.PathError{Op: "open", Path: r.URL.Path, Err: fs.ErrNotExist}).Error()))
+		return
+	}
+
+	// normalize slashes, so /dir goes to /dir/ and /page/ to /page
+	// unless directories are served inline, leaving aliases as they are
+	source := r.URL.Path
+	if target, ok := h.aliases[r.URL.Path]; ok {
+		source = target
+	} else if info, err := s.pageOrDir(r.URL.Path); err == nil {
+		w.Header().Set("Cache-Control", h.slashCacheHeader)
+		if info.IsDir() && !strings.HasSuffix(r.URL.Path, "/") && h.dirRedirect == 0 {
+			// relative links on the index then resolve against the parent,
+			// as they do in the browser
+			source = path.Join(source, "index")
+		} else if info.IsDir() && !strings.HasSuffix(r.URL.Path, "/") {
+			w.Header().Set("Location", path.Base(r.URL.Path)+"/")
+			w.WriteHeader(h.dirRedirect)
+			return
+		}
+		if !info.IsDir() && strings.HasSuffix(r.URL.Path, "/") {
+			status := h.dirRedirect
+			if status == 0 {
+				status = 303
+			}
+			w.Header().Set("Location", path.Join("..", path.Base(r.URL.Path), "/"))
+			w.WriteHeader(status)
+			return
+		}
+	} else if name, ok := s.matchCase(r.URL.Path); ok {
+		w.Header().Set("Cache-Control", h.slashCacheHeader)
+		w.Header().Set("Location", (&url.URL{Path: name, RawQuery: r.URL.RawQuery}).String())
+		w.WriteHeader(301)
+		return
+	}
+
+	m := h.newMinifier()
+
+	extension := path.Ext(source)
+	if extension != "" && extension != ".md" && extension != ".html" && !h.isLanguage(strings.TrimPrefix(extension, ".")) {
+		s.serveStatic(w, r, source, m)
+		return
+	}
+
+	// limit concurrent renders
+	if h.renders != nil {
+		select {
+		case h.renders <- struct{}{}:
+			defer func() { <-h.renders }()
+		default:
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(503)
+			w.Write([]byte("busy"))
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", h.pageCacheHeader)
+
+	// read file or index
+	if strings.HasSuffix(source, "/") {
+		source = path.Join(source, "index")
+	}
+
+	// read the variant of the page in the visitor's language if there is
+	// one, unless the path names the language
+	if len(h.languages) > 0 {
+		vary(w, "Accept-Language")
+		lang := h.languages[0]
+		if ext := strings.TrimPrefix(path.Ext(source), "."); h.isLanguage(ext) {
+			lang = ext
+		} else if accepted := h.pageLanguage(r); accepted != "" {
+			if info, err := s.readInfo(source + "." + accepted); err == nil && !info.IsDir() {
+				source += "." + accepted
+				lang = accepted
+			}
+		}
+		w.Header().Set("Content-Language", lang)
+	}
+	file, err := s.readExt(r.Context(), source)
+	var listing []byte
+	var prev, next string
+	if err != nil && h.tagPages && isTagPath(r.URL.Path) && !strings.HasSuffix(r.URL.Path, "/") {
+		w.Header().Set("Location", path.Base(r.URL.Path)+"/")
+		w.WriteHeader(303)
+		return
+	}
+	if err != nil && (h.tagPages && isTagPath(r.URL.Path) || h.listed(r.URL.Path) && strings.HasSuffix(r.URL.Path, "/")) {
+		pageNumber, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		listing, prev, next, err = s.renderIndex(r.URL.Path, pageNumber)
+	}
+	if err != nil && h.spaFallback != "" {
+		// only reached for paths without a static file extension, so missing
+		// assets aren't answered with the app
+		if fallback, err := s.read(h.spaFallback); err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(fallback)
+			return
+		}
+	}
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var meta map[string]string
+	meta, file = frontmatter(s.decode(source, file))
+	if cache, ok := meta["cache"]; ok && cacheControl.MatchString(cache) {
+		w.Header().Set("Cache-Control", cache)
+	}
+
+	// tell empty pages apart from ones that couldn't be read
+	if listing == nil && len(bytes.TrimSpace(file)) == 0 && h.emptyPage == "404" {
+		w.WriteHeader(404)
+		w.Write([]byte("empty page"))
+		return
+	}
+	if listing == nil && len(bytes.TrimSpace(file)) == 0 && h.emptyPage == "placeholder" {
+		file = []byte(h.emptyPlaceholder)
+	}
+
+	// render content
+	md := listing
+	if md == nil && bytes.Contains(file, []byte("{{#auth}}")) {
+		// pages with auth blocks differ by visitor, so they are neither
+		// cached here nor by shared caches
+		md = h.renderMarkdown(authBlocks(file, s.loggedIn(r)))
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else if md == nil {
+		md = s.renderPage(source, file)
+	}
+	content, err := parseContent(md)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// link to the markdown source, after the content so the link doesn't
+	// count towards reading time
+	if _, err := s.stat(source + ".md"); listing == nil && h.editURL != "" && err == nil {
+		md = append(md[:len(md):len(md)], h.editLink(source+".md")...)
+	}
+
+	// link the previous and next page, which head links also point to, the
+	// same for the page in every language
+	page, _ := h.stripLanguage(source)
+	if listing == nil && h.pageNav != "" && (source == r.URL.Path || page == r.URL.Path) && path.Base(page) != "index" {
+		before, after := s.neighbours(page)
+		md = append(md[:len(md):len(md)], pageNavLinks(before, after)...)
+		prev, next = url.PathEscape(before), url.PathEscape(after)
+	}
+
+	// parse HTML
+	rawDoc := s.assemble(h.pageTitle(content, r.URL.Path), upLink(r.URL.Path), r.URL.Path, md)
+	doc, err := html.Parse(bytes.NewReader(rawDoc))
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// allow the page's scripts and styles by a fresh nonce, given before
+	// the data-no-minify elements are set aside so theirs run too
+	var nonce string
+	if strings.Contains(h.csp, "{{nonce}}") {
+		var b [16]byte
+		rand.Read(b[:])
+		nonce = base64.StdEncoding.EncodeToString(b[:])
+		addNonce(doc, nonce)
+		w.Header().Set("Content-Security-Policy", strings.Replace(h.csp, "{{nonce}}", nonce, -1))
+	} else if h.csp != "" {
+		w.Header().Set("Content-Security-Policy", h.csp)
+	}
+
+	// set data-no-minify elements aside as parsed, so that neither
+	// annotation, rewrites nor minification change them
+	blocks := verbatim(doc)
+
+	h.reportBrokenLinks(w, r.URL.Path, s.annotate(doc, content, r.URL.Path, source, meta, prev, next))
+
+	// and the scripts and styles annotation added
+	if nonce != "" {
+		addNonce(doc, nonce)
+	}
+
+	// render, rewrite and minify HTML, then put the data-no-minify elements
+	// back
+	var unminified bytes.Buffer
+	html.Render(&unminified, doc)
+	rendered := unminified.Bytes()
+	for _, rule := range h.rewrites {
+		rendered = rule.apply(rendered)
+	}
+	if h.minifiers["html"] {
+		var minified bytes.Buffer
+		if err := m.Minify("text/html", &minified, bytes.NewReader(rendered)); err == nil {
+			rendered = minified.Bytes()
+		}
+	}
+	for i, block := range blocks {
+		rendered = bytes.Replace(rendered, []byte(placeholder(i)), block, 1)
+	}
+	w.Write(rendered)
+	w.WriteHeader(200)
+}
+
+type extraHeader struct {
+	name, value string
+	force       bool
+}
+
+// accessWriter records the status and size of a response for the access
+// log
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Flush keeps event streams working through the access log
+func (w *accessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (h *Handler) withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+		if aw.status == 0 {
+			aw.status = 200
+		}
+		h.logger.Printf("%s%s %s %s %d %d %v", h.requestID(r), r.RemoteAddr, r.Method, r.URL.RequestURI(), aw.status, aw.size, time.Since(start))
+	})
+}
+
+// requestIDs matches request ids taken from clients, which end up in logs
+var requestIDs = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID returns the id of the request followed by a space for logs, if
+// -request-id-header is set
+func (h *Handler) requestID(r *http.Request) string {
+	if h.requestIDHeader == "" {
+		return ""
+	}
+	return r.Header.Get(h.requestIDHeader) + " "
+}
+
+// withRequestID gives every request an id, or keeps the one it came with,
+// and echoes it in the response
+func (h *Handler) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(h.requestIDHeader)
+		if !h.requestIDIncoming || !requestIDs.MatchString(id) {
+			var b [16]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+			r.Header.Set(h.requestIDHeader, id)
+		}
+		w.Header().Set(h.requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerWriter adds headers to a response right before its header is
+// written
+type headerWriter struct {
+	http.ResponseWriter
+	headers     []extraHeader
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for _, h := range w.headers {
+			// a Vary given by flag adds to the one set here
+			if h.name == "Vary" && !h.force {
+				vary(w, h.value)
+				continue
+			}
+			if h.force || w.Header().Get(h.name) == "" {
+				w.Header().Set(h.name, h.value)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets the event stream through
+func (w *headerWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// newHandler chains the middleware around handle
+func (h *Handler) newHandler() http.Handler {
+	pages := etag.Handler(h.withHeaders(h.withRecover(http.HandlerFunc(h.handle))), true)
+	handler := pages
+	if h.eventsPath != "" {
+		// the event stream would be held back by the etag handler's buffering
+		events := h.withHeaders(h.withRecover(http.HandlerFunc(h.serveEvents)))
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == h.eventsPath {
+				events.ServeHTTP(w, r)
+				return
+			}
+			pages.ServeHTTP(w, r)
+		})
+	}
+	if h.accessLog {
+		handler = h.withAccessLog(handler)
+	}
+	if h.requestIDHeader != "" {
+		handler = h.withRequestID(handler)
+	}
+	return handler
+}
+
+// withRecover answers requests that panic with a 500 and the .500.html page,
+// if there is one, instead of dropping the connection
+func (h *Handler) withRecover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			stack := make([]byte, 64<<10)
+			stack = stack[:runtime.Stack(stack, false)]
+			h.logger.Printf("%s%s: panic: %v\n%s", h.requestID(r), r.URL.Path, err, stack)
+			page, err := h.siteFor(r.Host).control.read(".500.html")
+			if err == nil {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			} else {
+				page = []byte("internal server error")
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(500)
+			w.Write(page)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) withHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerWriter{ResponseWriter: w, headers: h.extraHeaders}
+		next.ServeHTTP(hw, r)
+		if !hw.wroteHeader {
+			hw.WriteHeader(200)
+		}
+	})
+}
+
+// Handler serves a directory of markdown pages as configured by New
+type Handler struct {
+	config
+	// flags are the options setting config
+	flags   *flag.FlagSet
+	handler http.Handler
+	logger  *log.Logger
+	// logLevel is the level given with -log-level
+	logLevel int
+	// unbrandedHome is the -no-branding title of a home page without a
+	// heading, the site name if one was given
+	unbrandedHome string
+	// minifiers are the types enabled with -minify
+	minifiers map[string]bool
+	// stopping is closed by Stop, ending event streams
+	stopping chan struct{}
+	stopOnce sync.Once
+	// lastmodLocation is the time zone given with -lastmod-tz
+	lastmodLocation *time.Location
+	// renders holds a token for every page being rendered
+	renders chan struct{}
+	// pageExts are the extensions of page sources, in order of preference
+	pageExts []string
+	// languages are the languages given with -languages, the default first
+	languages []string
+	// aliases are the files served at the paths given with -alias
+	aliases map[string]string
+	// extraHeaders are the response headers given with -header and
+	// -force-header
+	extraHeaders []extraHeader
+	// defaultSite is the site of the base directory, served to hosts not
+	// given with -vhost
+	defaultSite *site
+	// sites are the sites given with -vhost by host
+	sites map[string]*site
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r)
+}
+
+// Option changes the configuration of the handler New returns
+type Option func(h *Handler) error
+
+// Set returns an option setting the flag name, like "listing", to value,
+// which New fails with if it is invalid
+func Set(name, value string) Option {
+	return func(h *Handler) error {
+		if err := h.flags.Set(name, value); err != nil {
+			return errors.New("-" + name + ": " + err.Error())
+		}
+		return nil
+	}
+}
+
+// join returns an option applying opts in order
+func join(opts ...Option) Option {
+	return func(h *Handler) error {
+		for _, opt := range opts {
+			if err := opt(h); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WithMinify minifies only the types given, like "html" and "css", or
+// nothing without any
+func WithMinify(types ...string) Option {
+	return Set("minify", strings.Join(types, ","))
+}
+
+// WithAuth accepts the tokens besides the ones in .auth, which makes the
+// site private even without an .auth file
+func WithAuth(tokens ...string) Option {
+	var opts []Option
+	for _, token := range tokens {
+		opts = append(opts, Set("auth-token", token))
+	}
+	return join(opts...)
+}
+
+// WithAuthCookie names the auth cookie and sets how long it lasts
+func WithAuthCookie(name string, maxAge time.Duration) Option {
+	return join(Set("auth-cookie", name), Set("auth-max-age", maxAge.String()))
+}
+
+// WithSecureCookies marks auth cookies secure always or on "tls" requests
+// only
+func WithSecureCookies(when string) Option {
+	return Set("secure-cookies", when)
+}
+
+// WithCacheControl sets the Cache-Control of rendered pages and static
+// files
+func WithCacheControl(page, static string) Option {
+	return join(Set("page-cache-control", page), Set("static-cache-control", static))
+}
+
+// WithSiteName sets the site name used in page titles
+func WithSiteName(name string) Option {
+	return Set("site-name", name)
+}
+
+// WithListing lists the contents of directories without an index
+func WithListing(listing bool) Option {
+	return Set("listing", strconv.FormatBool(listing))
+}
+
+// WithTags serves listings of pages by their tags under /tags/
+func WithTags(tags bool) Option {
+	return Set("tags", strconv.FormatBool(tags))
+}
+
+// WithCache caches rendered pages until their source changes
+func WithCache(cache bool) Option {
+	return Set("cache", strconv.FormatBool(cache))
+}
+
+// WithMaxRenders limits the number of pages rendered at once, 0 for no
+// limit
+func WithMaxRenders(n int) Option {
+	return Set("max-renders", strconv.Itoa(n))
+}
+
+// WithStylesheets links the stylesheets from every page
+func WithStylesheets(hrefs ...string) Option {
+	var opts []Option
+	for _, href := range hrefs {
+		opts = append(opts, Set("css", href))
+	}
+	return join(opts...)
+}
+
+// WithScripts loads the scripts on every page
+func WithScripts(srcs ...string) Option {
+	var opts []Option
+	for _, src := range srcs {
+		opts = append(opts, Set("js", src))
+	}
+	return join(opts...)
+}
+
+// WithHeader adds a response header unless nerka sets it, or replaces it
+// with force
+func WithHeader(name, value string, force bool) Option {
+	if force {
+		return Set("force-header", name+": "+value)
+	}
+	return Set("header", name+": "+value)
+}
+
+// WithReplace replaces old with new in rendered pages
+func WithReplace(old, new string) Option {
+	return Set("replace", old+"=>"+new)
+}
+
+// registered are the flag sets the options were registered with, their
+// values being shared with the options
+var registered []*flag.FlagSet
+
+// RegisterFlags registers the options of New as flags of fs, so that
+// parsing fs configures New
+func RegisterFlags(fs *flag.FlagSet) {
+	options.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	registered = append(registered, fs)
+}
+
+// Stop ends the event streams, which would hold up shutting down servers
+// using the handler, and the refreshing of the -tags index. Stopping a
+// stopped handler does nothing.
+func (h *Handler) Stop() {
+	h.stopOnce.Do(func() { close(h.stopping) })
+}
+
+// New returns the handler serving the directory root with the options
+// given as flags and opts, or an error if they are invalid.
+func New(root string, opts ...Option) (*Handler, error) {
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, errors.New("base directory is not a directory: " + root)
+	}
+	return NewFS(dirFS(root), opts...)
+}
+
+// NewFS is like New but serves the file system files, like an embed.FS,
+// instead of a directory. Hosts given with -vhost are still served from
+// directories.
+func NewFS(files fs.FS, opts ...Option) (*Handler, error) {
+	h := &Handler{
+		flags:         flag.NewFlagSet("nerka", flag.ContinueOnError),
+		logger:        log.Default(),
+		unbrandedHome: "/",
+		minifiers:     map[string]bool{"html": false, "css": false, "js": false, "svg": false, "json": false, "xml": false},
+		stopping:      make(chan struct{}),
+		pageExts:      []string{".md", ".html", ".ipynb"},
+		aliases:       map[string]string{},
+		sites:         map[string]*site{},
+	}
+	// the flags set the fields of h.config, which start out as the options
+	// given on the command line
+	h.config.register(h.flags)
+	h.config = defaults.clone()
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, err
+		}
+	}
+	s, err := h.siteFS(files)
+	if err != nil {
+		return nil, err
+	}
+	h.defaultSite = s
+	if h.canonicalHost != "" && len(h.vhosts) > 0 {
+		return nil, errors.New("-canonical-host would redirect the hosts given with -vhost")
+	}
+	for _, value := range h.vhosts {
+		i := strings.Index(value, "=")
+		if i <= 0 {
+			return nil, errors.New("invalid vhost: " + value)
+		}
+		dir := value[i+1:]
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, errors.New("vhost directory is not a directory: " + dir)
+		}
+		s, err := h.siteFS(dirFS(dir))
+		if err != nil {
+			return nil, err
+		}
+		h.sites[strings.ToLower(value[:i])] = s
+	}
+	all := []*site{h.defaultSite}
+	for _, s := range h.sites {
+		all = append(all, s)
+	}
+	level, ok := logLevels[h.logLevelName]
+	if !ok {
+		return nil, errors.New("invalid log level: " + h.logLevelName)
+	}
+	h.logLevel = level
+	if h.logFile != "" {
+		if h.logMaxSize <= 0 || h.logMaxBackups < 0 {
+			return nil, errors.New("-log-file needs a positive -log-max-size and -log-max-backups of at least 0")
+		}
+		output := &rotator{name: h.logFile, maxSize: h.logMaxSize << 20, maxBackups: h.logMaxBackups}
+		if err := output.open(); err != nil {
+			return nil, err
+		}
+		h.logger = log.New(output, "", log.LstdFlags)
+	}
+	for _, value := range []string{h.pageCacheHeader, h.staticCacheHeader, h.slashCacheHeader, h.versionedHeader} {
+		if !cacheControl.MatchString(value) {
+			return nil, errors.New("invalid Cache-Control: " + value)
+		}
+	}
+	if h.authCookie == "" || h.authMaxAge <= 0 {
+		return nil, errors.New("-auth-cookie needs a name and a positive -auth-max-age")
+	}
+	if h.cacheKey != "mtime" && h.cacheKey != "hash" {
+		return nil, errors.New("invalid -cache-key: " + h.cacheKey)
+	}
+	if h.secureCookies != "always" && h.secureCookies != "tls" {
+		return nil, errors.New("invalid -secure-cookies: " + h.secureCookies)
+	}
+	if strings.ContainsAny(h.canonicalHost, "/?#@ ") {
+		return nil, errors.New("invalid canonical host: " + h.canonicalHost)
+	}
+	if h.eventsPath != "" && !strings.HasPrefix(h.eventsPath, "/") || h.eventsInterval <= 0 {
+		return nil, errors.New("-events needs a path starting with / and a positive -events-interval")
+	}
+	for _, name := range strings.Split(h.minifyTypes, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := h.minifiers[name]; !ok {
+			return nil, errors.New("invalid minify type: " + name)
+		}
+		h.minifiers[name] = true
+	}
+	// the older switches take types out of -minify
+	h.minifiers["json"] = h.minifiers["json"] && h.minifyJSON
+	h.minifiers["xml"] = h.minifiers["xml"] && h.minifyXML
+	if h.convertTimeout <= 0 {
+		return nil, errors.New("-convert-timeout must be positive")
+	}
+	if h.asciidoctor != "" {
+		h.pageExts = append(h.pageExts, ".adoc")
+	}
+	if h.rst2html != "" {
+		h.pageExts = append(h.pageExts, ".rst")
+	}
+	if h.txtPages {
+		h.pageExts = append(h.pageExts, ".txt")
+	}
+	if _, ok := slugifiers[h.headingSlugs]; !ok {
+		return nil, errors.New("invalid -heading-slugs: " + h.headingSlugs)
+	}
+	if h.slugCase != "lower" && h.slugCase != "keep" {
+		return nil, errors.New("invalid -slug-case: " + h.slugCase)
+	}
+	if h.listingScope != "all" && h.listingScope != "root" {
+		return nil, errors.New("invalid -listing-scope: " + h.listingScope)
+	}
+	for _, lang := range strings.Split(h.languageList, ",") {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if lang == "" {
+			continue
+		}
+		if strings.ContainsAny(lang, "./ ") {
+			return nil, errors.New("invalid language: " + lang)
+		}
+		h.languages = append(h.languages, lang)
+	}
+	if h.emptyPage != "render" && h.emptyPage != "404" && h.emptyPage != "placeholder" {
+		return nil, errors.New("invalid -empty-page: " + h.emptyPage)
+	}
+	if h.jsonLD != "minify" && h.jsonLD != "verbatim" {
+		return nil, errors.New("invalid -json-ld: " + h.jsonLD)
+	}
+	if h.pageNav != "" && h.pageNav != "order" && h.pageNav != "alpha" {
+		return nil, errors.New("invalid -page-nav: " + h.pageNav)
+	}
+	if h.shadow != "page" && h.shadow != "dir" {
+		return nil, errors.New("invalid -shadow: " + h.shadow)
+	}
+	if h.dirRedirect != 0 && h.dirRedirect != 301 && h.dirRedirect != 302 && h.dirRedirect != 303 && h.dirRedirect != 307 && h.dirRedirect != 308 {
+		return nil, errors.New("invalid directory redirect status: " + strconv.Itoa(h.dirRedirect))
+	}
+	if h.maxRenders > 0 {
+		h.renders = make(chan struct{}, h.maxRenders)
+	}
+	for _, set := range append([]*flag.FlagSet{options, h.flags}, registered...) {
+		set.Visit(func(f *flag.Flag) {
+			if f.Name == "site-name" {
+				h.unbrandedHome = h.siteName
+			}
+		})
+	}
+	location, err := time.LoadLocation(h.lastmodTimezone)
+	if err != nil {
+		return nil, err
+	}
+	h.lastmodLocation = location
+	if h.rawHTML != "allow" && h.rawHTML != "skip" && h.rawHTML != "escape" {
+		return nil, errors.New("invalid -raw-html: " + h.rawHTML)
+	}
+	if h.listingPageSize <= 0 {
+		return nil, errors.New("-listing-page-size must be positive")
+	}
+	if h.wordsPerMinute <= 0 {
+		return nil, errors.New("-wpm must be positive")
+	}
+	if h.dir != "ltr" && h.dir != "rtl" && h.dir != "auto" {
+		return nil, errors.New("invalid text direction: " + h.dir)
+	}
+	for _, class := range []string{h.brokenLinkClass, h.externalLinkClass} {
+		if !cssIdentifier.MatchString(class) {
+			return nil, errors.New("invalid class name: " + class)
+		}
+	}
+	if h.scrollMargin != "" && !cssLength.MatchString(h.scrollMargin) {
+		return nil, errors.New("invalid scroll margin: " + h.scrollMargin)
+	}
+	for _, class := range []string{h.dlClass, h.scrollClass} {
+		if class != "" && !cssIdentifier.MatchString(class) {
+			return nil, errors.New("invalid class name: " + class)
+		}
+	}
+	for _, flags := range []struct {
+		values listFlag
+		force  bool
+	}{{h.headerFlags, false}, {h.forceHeaderFlags, true}} {
+		for _, value := range flags.values {
+			i := strings.Index(value, ":")
+			if i <= 0 {
+				return nil, errors.New("invalid header: " + value)
+			}
+			name := http.CanonicalHeaderKey(strings.TrimSpace(value[:i]))
+			h.extraHeaders = append(h.extraHeaders, extraHeader{name, strings.TrimSpace(value[i+1:]), flags.force})
+		}
+	}
+	for _, value := range h.aliasFlags {
+		i := strings.Index(value, "=")
+		if i <= 0 || !strings.HasPrefix(value, "/") {
+			return nil, errors.New("invalid alias: " + value)
+		}
+		target := value[i+1:]
+		if !strings.HasPrefix(target, "/") || path.Clean(target) != target || target == "/" {
+			return nil, errors.New("invalid alias target: " + value)
+		}
+		h.aliases[value[:i]] = target
+	}
+	if h.tagPages {
+		for _, s := range all {
+			if err := s.indexTags(); err != nil {
+				return nil, err
+			}
+		}
+		go func() {
+			ticker := time.NewTicker(h.tagsRefresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-h.stopping:
+					return
+				}
+				for _, s := range all {
+					if err := s.indexTags(); err != nil {
+						h.logger.Print(err)
+					}
+				}
+			}
+		}()
+	}
+	if h.warm {
+		if !h.pageCache || h.warmWorkers <= 0 {
+			return nil, errors.New("-warm needs -cache and a positive -warm-workers")
+		}
+		go func() {
+			start := time.Now()
+			for _, s := range all {
+				if err := s.warmCache(); err != nil {
+					h.logger.Print(err)
+				}
+			}
+			h.debugf("warmed the cache in %v", time.Since(start))
+		}()
+	}
+	h.handler = h.newHandler()
+	return h, nil
+}
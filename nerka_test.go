@@ -0,0 +1,1372 @@
+package nerka
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// fixture writes files, by slash-separated name, to a temporary directory
+// and returns it
+func fixture(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// client doesn't follow redirects, so that tests see them
+var client = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// serve starts a test server for h, stopped with the test
+func serve(t *testing.T, h *Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		h.Stop()
+		srv.Close()
+	})
+	return srv
+}
+
+// newServer serves the directory of files with opts
+func newServer(t *testing.T, files map[string]string, opts ...Option) *httptest.Server {
+	t.Helper()
+	h, err := New(fixture(t, files), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serve(t, h)
+}
+
+// get requests urlPath from srv and returns the response with its body
+func get(t *testing.T, srv *httptest.Server, method, urlPath string, header ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+urlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestNewFS(t *testing.T) {
+	files := fstest.MapFS{
+		"index.md":      {Data: []byte("# Home\n\nSee [about](about) and [docs](docs/).\n")},
+		"about.md":      {Data: []byte("# About\n")},
+		"docs/index.md": {Data: []byte("# Docs\n")},
+		"style.css":     {Data: []byte("body { color: red; }\n")},
+	}
+	h, err := NewFS(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, h)
+
+	resp, body := get(t, srv, "GET", "/")
+	if resp.StatusCode != 200 || !strings.Contains(body, "<h1>Home</h1>") {
+		t.Errorf("/: got %d %q", resp.StatusCode, body)
+	}
+	if strings.Contains(body, "broken-link") {
+		t.Errorf("/: links to pages in the file system are flagged broken: %q", body)
+	}
+	resp, body = get(t, srv, "GET", "/docs/")
+	if resp.StatusCode != 200 || !strings.Contains(body, "<h1>Docs</h1>") {
+		t.Errorf("/docs/: got %d %q", resp.StatusCode, body)
+	}
+	resp, body = get(t, srv, "GET", "/style.css")
+	if resp.StatusCode != 200 || body != "body{color:red}" {
+		t.Errorf("/style.css: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestNewFSContentDir(t *testing.T) {
+	files := fstest.MapFS{
+		".auth":            {Data: []byte("secret\n")},
+		"content/index.md": {Data: []byte("# Home\n")},
+	}
+	h, err := NewFS(files, Set("content-dir", "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, h)
+	if resp, _ := get(t, srv, "GET", "/"); resp.StatusCode != 403 {
+		t.Errorf("/ without a cookie: got %d, want 403 from the .auth above the content directory", resp.StatusCode)
+	}
+	resp, body := get(t, srv, "GET", "/", "Cookie", "nerka=secret")
+	if resp.StatusCode != 200 || !strings.Contains(body, "<h1>Home</h1>") {
+		t.Errorf("/ with a cookie: got %d %q", resp.StatusCode, body)
+	}
+
+	if _, err := NewFS(files, Set("content-dir", "missing")); err == nil {
+		t.Error("a missing -content-dir is accepted")
+	}
+}
+
+// pages is the fixture of the integration tests
+var pages = map[string]string{
+	"index.md":      "# Home\n\nSee [the page](page) and [the docs](docs/).\n",
+	"page.md":       "# Page\n\nHello, *world*.\n",
+	"docs/index.md": "# Docs\n",
+	"style.css":     "body { color: red; }\n",
+}
+
+func TestMarkdownPage(t *testing.T) {
+	srv := newServer(t, pages)
+	resp, body := get(t, srv, "GET", "/page")
+	if resp.StatusCode != 200 {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "max-age=10" {
+		t.Errorf("got Cache-Control %q", got)
+	}
+	if resp.Header.Get("Etag") == "" {
+		t.Error("got no Etag")
+	}
+	for _, want := range []string{"<title>nerka: Page</title>", "<h1>Page</h1>", "<p>Hello, <em>world</em>."} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body %q lacks %q", body, want)
+		}
+	}
+
+	_, body = get(t, srv, "GET", "/")
+	if strings.Contains(body, "broken-link") {
+		t.Errorf("links to existing pages are flagged broken: %q", body)
+	}
+}
+
+func TestStaticFile(t *testing.T) {
+	srv := newServer(t, pages)
+	resp, body := get(t, srv, "GET", "/style.css")
+	if resp.StatusCode != 200 || body != "body{color:red}" {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/css; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "max-age=300, stale-while-revalidate=28800" {
+		t.Errorf("got Cache-Control %q", got)
+	}
+
+	resp, body = get(t, srv, "HEAD", "/style.css")
+	if resp.StatusCode != 200 || body != "" {
+		t.Errorf("HEAD: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestSlashRedirects(t *testing.T) {
+	srv := newServer(t, pages)
+	for _, test := range []struct {
+		path, location string
+	}{
+		{"/docs", "docs/"},
+		{"/page/", "../page"},
+	} {
+		resp, _ := get(t, srv, "GET", test.path)
+		if resp.StatusCode != 303 || resp.Header.Get("Location") != test.location {
+			t.Errorf("%s: got %d to %q, want 303 to %q", test.path, resp.StatusCode, resp.Header.Get("Location"), test.location)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != "max-age=604800" {
+			t.Errorf("%s: got Cache-Control %q", test.path, got)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	files := map[string]string{".auth": "tok\n", "page.md": "# Page\n"}
+	srv := newServer(t, files)
+
+	resp, body := get(t, srv, "GET", "/page")
+	if resp.StatusCode != 403 || strings.Contains(body, "Page") {
+		t.Errorf("without a cookie: got %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Vary"); got != "Cookie" {
+		t.Errorf("got Vary %q", got)
+	}
+
+	resp, _ = get(t, srv, "GET", "/.auth/tok")
+	cookies := resp.Cookies()
+	if resp.StatusCode != 303 || len(cookies) != 1 || cookies[0].Name != "nerka" || cookies[0].Value != "tok" {
+		t.Errorf("/.auth/tok: got %d with cookies %v", resp.StatusCode, cookies)
+	}
+
+	resp, body = get(t, srv, "GET", "/page", "Cookie", "nerka=tok")
+	if resp.StatusCode != 200 || !strings.Contains(body, "<h1>Page</h1>") {
+		t.Errorf("with a cookie: got %d %q", resp.StatusCode, body)
+	}
+	resp, _ = get(t, srv, "GET", "/page", "Cookie", "nerka=bad")
+	if resp.StatusCode != 403 {
+		t.Errorf("with a bad cookie: got %d", resp.StatusCode)
+	}
+}
+
+func TestTraversal(t *testing.T) {
+	dir := fixture(t, map[string]string{"secret.txt": "top secret\n", "site/page.md": "# Page\n"})
+	h, err := New(filepath.Join(dir, "site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, h)
+	for _, urlPath := range []string{"/../secret.txt", "/%2e%2e/secret.txt", "/..%2fsecret.txt", "/sub/../../secret.txt", "/../site/../secret"} {
+		resp, body := get(t, srv, "GET", urlPath)
+		if strings.Contains(body, "top secret") {
+			t.Errorf("%s: got %d %q", urlPath, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestDotfiles(t *testing.T) {
+	files := map[string]string{
+		".auth":                    "tok\n",
+		".header":                  "<p>header</p>\n",
+		"sub/.order":               "page\n",
+		"sub/page.md":              "# Page\n",
+		".well-known/security.txt": "Contact: mailto:security@example.com\n",
+	}
+	srv := newServer(t, files, Set("auth-optional", "true"))
+	for urlPath, secret := range map[string]string{"/.auth": "tok", "/.header": "<p>", "/sub/.order": "page", "/sub/./.order": "page"} {
+		resp, body := get(t, srv, "GET", urlPath)
+		if strings.Contains(body, secret) || resp.StatusCode != 200 || resp.Header.Get("Location") != "" {
+			t.Errorf("%s: got %d %q", urlPath, resp.StatusCode, body)
+		}
+	}
+	resp, body := get(t, srv, "GET", "/.well-known/security.txt")
+	if resp.StatusCode != 200 || !strings.Contains(body, "Contact:") {
+		t.Errorf("/.well-known/security.txt: got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := get(t, srv, "GET", "/sub/page"); resp.StatusCode != 200 || !strings.Contains(body, "<h1>Page</h1>") {
+		t.Errorf("/sub/page: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestAuthRotation(t *testing.T) {
+	dir := fixture(t, map[string]string{".auth": "new\nold\n", "page.md": "# Page\n"})
+	h, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, h)
+
+	for _, token := range []string{"new", "old"} {
+		if resp, _ := get(t, srv, "GET", "/page", "Cookie", "nerka="+token); resp.StatusCode != 200 {
+			t.Errorf("%s token: got %d during the grace period", token, resp.StatusCode)
+		}
+	}
+	// the old token doesn't reveal the new one
+	if _, body := get(t, srv, "GET", "/.auth", "Cookie", "nerka=old"); strings.Contains(body, "new") {
+		t.Errorf("/.auth with the old token: got %q", body)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ".auth"), []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := get(t, srv, "GET", "/page", "Cookie", "nerka=old"); resp.StatusCode != 403 {
+		t.Errorf("old token: got %d after it was dropped", resp.StatusCode)
+	}
+	if resp, _ := get(t, srv, "GET", "/page", "Cookie", "nerka=new"); resp.StatusCode != 200 {
+		t.Errorf("new token: got %d after the old one was dropped", resp.StatusCode)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h, err := New(fixture(t, map[string]string{".500.html": "<h1>Oops</h1>\n"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+	h.logger = log.New(io.Discard, "", 0)
+	handler := h.withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("bug")
+	}))
+	// the recorder keeps the header as it was on WriteHeader
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+	resp := w.Result()
+	if resp.StatusCode != 500 || w.Body.String() != "<h1>Oops</h1>\n" {
+		t.Errorf("got %d %q", resp.StatusCode, w.Body.String())
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("got Cache-Control %q", got)
+	}
+}
+
+func TestTxtPages(t *testing.T) {
+	files := map[string]string{"notes.txt": "a <b> & c\n", "robots.txt": "User-agent: *\nDisallow:\n"}
+	srv := newServer(t, files, Set("txt-pages", "true"))
+
+	resp, body := get(t, srv, "GET", "/notes")
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" || !strings.Contains(body, "a &lt;b&gt; &amp; c") {
+		t.Errorf("/notes: got %d %s %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	for urlPath, want := range files {
+		resp, body := get(t, srv, "GET", "/"+urlPath)
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" || body != want {
+			t.Errorf("/%s: got %d %s %q", urlPath, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+}
+
+func TestSmartypants(t *testing.T) {
+	files := map[string]string{"page.md": "# Page\n\nIt's \"quoted\" -- and more...\n\n    keep -- \"this\"\n"}
+	_, body := get(t, newServer(t, files), "GET", "/page")
+	if !strings.Contains(body, "It's \"quoted\" -- and more...") {
+		t.Errorf("prose changed by default: %q", body)
+	}
+	_, body = get(t, newServer(t, files, Set("smartypants", "true")), "GET", "/page")
+	if strings.Contains(body, "It's \"quoted\" -- and more...") {
+		t.Errorf("prose unchanged with -smartypants: %q", body)
+	}
+	if !strings.Contains(body, "keep -- &#34;this&#34;") {
+		t.Errorf("code changed with -smartypants: %q", body)
+	}
+}
+
+func TestMinifyTypes(t *testing.T) {
+	files := map[string]string{
+		"page.md":  "# Page\n\n<script>var   a = 1;</script>\n",
+		"f.json":   "{ \"a\": 1 }\n",
+		"f.xml":    "<a>  <b/>  </a>\n",
+		"s.css":    "body { color: red; }\n",
+		"index.md": "# Home\n",
+	}
+	for _, test := range []struct {
+		name string
+		opts []Option
+		// minified are the files expected minified
+		minified map[string]bool
+	}{
+		{"default", nil, map[string]bool{"f.json": true, "f.xml": true, "s.css": true}},
+		{"html,css", []Option{WithMinify("html", "css")}, map[string]bool{"s.css": true}},
+		{"json", []Option{WithMinify("json")}, map[string]bool{"f.json": true}},
+		{"old switches", []Option{Set("minify-json", "false"), Set("minify-xml", "false")}, map[string]bool{"s.css": true}},
+	} {
+		srv := newServer(t, files, test.opts...)
+		for _, name := range []string{"f.json", "f.xml", "s.css"} {
+			_, body := get(t, srv, "GET", "/"+name)
+			if minified := body != files[name]; minified != test.minified[name] {
+				t.Errorf("%s: %s minified %v: %q", test.name, name, minified, body)
+			}
+		}
+	}
+	_, body := get(t, newServer(t, files, WithMinify("html")), "GET", "/page")
+	if !strings.Contains(body, "<script>var   a = 1;</script>") {
+		t.Errorf("js minified without js in -minify: %q", body)
+	}
+}
+
+func TestLinksToConvertedPages(t *testing.T) {
+	files := map[string]string{
+		"index.md": "# Home\n\n[doc](doc) and [rst](rst) and [missing](missing)\n",
+		"doc.adoc": "= Doc\n",
+		"rst.rst":  "Rst\n===\n",
+	}
+	// the converters can't run, which link checks mustn't need
+	srv := newServer(t, files, Set("asciidoctor", "nerka-test-missing-asciidoctor"), Set("rst2html", "nerka-test-missing-rst2html"))
+	_, body := get(t, srv, "GET", "/")
+	for _, link := range []string{"<a href=doc>", "<a href=rst>", "<a href=missing class=broken-link>"} {
+		if !strings.Contains(body, link) {
+			t.Errorf("body %q lacks %q", body, link)
+		}
+	}
+}
+
+// converter writes a shell script standing in for a page converter
+func converter(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("converters are shell scripts")
+	}
+	file := filepath.Join(t.TempDir(), "convert")
+	if err := os.WriteFile(file, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConvertedPages(t *testing.T) {
+	files := map[string]string{
+		"doc.adoc": "<p><a href=\"missing\">missing</a> <a href=\"doc\">doc</a></p>\n",
+		"slow.rst": "Slow\n",
+	}
+	srv := newServer(t, files,
+		Set("asciidoctor", converter(t, "exec cat")),
+		Set("rst2html", converter(t, "exec sleep 10")),
+		Set("convert-timeout", "100ms"))
+
+	_, body := get(t, srv, "GET", "/doc")
+	for _, link := range []string{"<a href=missing class=broken-link>", "<a href=doc>"} {
+		if !strings.Contains(body, link) {
+			t.Errorf("/doc: body %q lacks %q", body, link)
+		}
+	}
+
+	start := time.Now()
+	_, body = get(t, srv, "GET", "/slow")
+	if time.Since(start) > 5*time.Second || !strings.Contains(body, "deadline exceeded") {
+		t.Errorf("/slow: got %q after %v", body, time.Since(start))
+	}
+}
+
+func TestTagIndex(t *testing.T) {
+	dir := fixture(t, map[string]string{
+		"a.md": "---\ntags: go\n---\n# Alpha\n",
+		"b.md": "---\ntags: go, web\n---\n# Beta\n",
+	})
+	h, err := New(dir, WithTags(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+	s := h.defaultSite
+	names := func(tag string) []string {
+		_, entries, _ := s.tagEntries(tag)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+	if got := names("go"); len(got) != 2 || got[0] != "Alpha" || got[1] != "Beta" {
+		t.Errorf("go: got %v", got)
+	}
+
+	// a page keeping its mtime and size isn't read again
+	file := filepath.Join(dir, "a.md")
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("---\ntags: go\n---\n# Gamma\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.indexTags(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("go"); len(got) != 2 || got[0] != "Alpha" {
+		t.Errorf("go after an unchanged stat: got %v", got)
+	}
+
+	// changed and removed pages are
+	if err := os.WriteFile(file, []byte("---\ntags: web\n---\n# Alpha 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "b.md")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.indexTags(); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("go"); len(got) != 0 {
+		t.Errorf("go after changes: got %v", got)
+	}
+	if got := names("web"); len(got) != 1 || got[0] != "Alpha 2" {
+		t.Errorf("web after changes: got %v", got)
+	}
+}
+
+func TestVerbatimBlocks(t *testing.T) {
+	files := map[string]string{"page.md": "# Page\n\n" +
+		"<div data-no-minify class='a'><a href=\"missing\" onclick=\"go('x') && stop()\">var</a>   <script>var   a  = 1;</script></div>\n\n" +
+		"<p><a href=\"missing\">var</a>   <script>var   b  = 2;</script></p>\n"}
+	srv := newServer(t, files, Set("csp", "script-src 'nonce-{{nonce}}'"), WithReplace("var", "let"))
+	resp, body := get(t, srv, "GET", "/page")
+	if resp.Header.Get("Content-Security-Policy") == "" {
+		t.Error("got no Content-Security-Policy")
+	}
+	// the block is rendered as parsed: text, attribute values and scripts
+	// stay, attributes get quoted and escaped, and scripts get the nonce
+	nonce := strings.TrimPrefix(strings.SplitN(resp.Header.Get("Content-Security-Policy"), "'", 3)[1], "nonce-")
+	block := `<div data-no-minify="" class="a"><a href="missing" onclick="go(&#39;x&#39;) &amp;&amp; stop()">var</a>   <script nonce="` + nonce + `">var   a  = 1;</script></div>`
+	if !strings.Contains(body, block) {
+		t.Errorf("body %q lacks %q", body, block)
+	}
+	// the rest of the page is annotated, rewritten, given nonces and
+	// minified
+	if !strings.Contains(body, "<a href=missing class=broken-link>let</a>") || !strings.Contains(body, `<script nonce="`+nonce+`">let b=2</script>`) {
+		t.Errorf("body %q isn't processed outside the block", body)
+	}
+}
+
+func TestLinkTarget(t *testing.T) {
+	for _, test := range []struct {
+		page, link, want string
+	}{
+		{"/docs/page", "other", "/docs/other"},
+		{"/docs/page", "../top", "/top"},
+		{"/docs/", "other", "/docs/other"},
+		{"/docs/page", "/top", "/top"},
+		{"/docs/page", "/sub/page", "/sub/page"},
+		{"/docs/page", "", "/docs/page"},
+	} {
+		if got := linkTarget(test.page, test.link); got != test.want {
+			t.Errorf("linkTarget(%q, %q) = %q, want %q", test.page, test.link, got, test.want)
+		}
+	}
+}
+
+func TestRootAbsoluteLinks(t *testing.T) {
+	files := map[string]string{
+		"top.md":            "# Top\n",
+		"docs/index.md":     "# Docs\n",
+		"docs/guide/one.md": "# One\n\n[root](/top) [relative](../) [sibling](two) [root sibling](/docs/guide/two)\n",
+		"docs/guide/two.md": "# Two\n",
+	}
+	_, body := get(t, newServer(t, files), "GET", "/docs/guide/one")
+	for _, link := range []string{"<a href=/top>", "<a href=../>", "<a href=two>", "<a href=/docs/guide/two>"} {
+		if !strings.Contains(body, link) {
+			t.Errorf("body %q lacks %q", body, link)
+		}
+	}
+	h, err := New(fixture(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+	for link, want := range map[string]bool{"/top": true, "/docs/guide/two": true, "/guide/two": false, "/docs/top": false} {
+		if got := h.defaultSite.exists(linkTarget("/docs/guide/one", link)); got != want {
+			t.Errorf("link %s exists %v, want %v", link, got, want)
+		}
+	}
+}
+
+func TestLinksWithQueryAndFragment(t *testing.T) {
+	files := map[string]string{
+		"index.md": "# Home\n\n[q](page?x=1) [f](page#sec) [qf](page?x=1#sec) [self](#sec) [missing](nope?x=1#sec)\n",
+		"page.md":  "# Page\n",
+	}
+	_, body := get(t, newServer(t, files), "GET", "/")
+	for _, link := range []string{`<a href="page?x=1">`, `<a href=page#sec>`, `<a href="page?x=1#sec">`, `<a href=#sec>`, `<a href="nope?x=1#sec" class=broken-link>`} {
+		if !strings.Contains(body, link) {
+			t.Errorf("body %q lacks %q", body, link)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	dir := fixture(t, map[string]string{"secret.txt": "top secret\n", "site/page.md": "# Page\n"})
+	base := filepath.Join(dir, "site")
+	for link, target := range map[string]string{"escape.txt": filepath.Join(dir, "secret.txt"), "up": "..", "alias.md": "page.md"} {
+		if err := os.Symlink(target, filepath.Join(base, link)); err != nil {
+			t.Skip("can't create symlinks:", err)
+		}
+	}
+	for _, name := range []string{"escape.txt", "up/secret.txt"} {
+		if file, err := dirFS(base).resolve(name); err == nil {
+			t.Errorf("resolve(%q) = %q, want an error", name, file)
+		}
+	}
+	if _, err := dirFS(base).resolve("alias.md"); err != nil {
+		t.Errorf("a symlink within the base directory is refused: %v", err)
+	}
+
+	h, err := New(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, h)
+	for _, urlPath := range []string{"/escape.txt", "/up/secret.txt"} {
+		if _, body := get(t, srv, "GET", urlPath); strings.Contains(body, "top secret") {
+			t.Errorf("%s: got %q", urlPath, body)
+		}
+	}
+	if resp, body := get(t, srv, "GET", "/alias"); resp.StatusCode != 200 || !strings.Contains(body, "<h1>Page</h1>") {
+		t.Errorf("/alias: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestWithin(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "base")
+	for _, test := range []struct {
+		file string
+		want bool
+	}{
+		{base, true},
+		{filepath.Join(base, "."), true},
+		{filepath.Join(base, "page.md"), true},
+		{filepath.Join(base, "a", "..", "page.md"), true},
+		{filepath.Join(base, ".."), false},
+		{filepath.Join(base, "..", "secret"), false},
+		{filepath.Join(base, "a", "..", "..", "secret"), false},
+		{base + "2", false},
+		{filepath.Join(base, "..foo"), true},
+	} {
+		if got := within(base, test.file); got != test.want {
+			t.Errorf("within(%q, %q) = %v, want %v", base, test.file, got, test.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	base := fixture(t, map[string]string{"page.md": "# Page\n", "sub/page.md": "# Sub\n"})
+	for _, name := range []string{".", "page.md", "sub", "sub/page.md"} {
+		if _, err := dirFS(base).resolve(name); err != nil {
+			t.Errorf("resolve(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"..", "../page.md", "sub/..", "sub/../..", "sub/../../page.md", "/page.md", "/etc/passwd", base + "/page.md"} {
+		if file, err := dirFS(base).resolve(name); err == nil {
+			t.Errorf("resolve(%q) = %q, want an error", name, file)
+		}
+	}
+	for _, test := range []struct {
+		name, want string
+		err        bool
+	}{
+		{"/", ".", false},
+		{"/page.md", "page.md", false},
+		{"/sub/../page.md", "page.md", false},
+		{"//page.md", "page.md", false},
+		{"/..", "", true},
+		{"/../page.md", "", true},
+		{"/sub/../../page.md", "", true},
+	} {
+		got, err := sitePath(test.name)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("sitePath(%q) = %q, %v", test.name, got, err)
+		}
+	}
+}
+
+func TestBackslashes(t *testing.T) {
+	dir := fixture(t, map[string]string{"secret.txt": "top secret\n", "site/page.md": "# Page\n"})
+	base := filepath.Join(dir, "site")
+	for _, name := range []string{`..\secret.txt`, `sub\..\..\secret.txt`} {
+		file, err := dirFS(base).resolve(name)
+		if runtime.GOOS == "windows" && err == nil {
+			t.Errorf("resolve(%q) = %q, want an error", name, file)
+		}
+		if err == nil && !within(base, file) {
+			t.Errorf("resolve(%q) = %q, outside the base directory", name, file)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		if within(base, base+`\..\secret.txt`) {
+			t.Errorf("within accepts a backslash path climbing out of the base")
+		}
+	}
+
+	h, err := New(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, h)
+	for _, urlPath := range []string{"/..%5csecret.txt", "/%5c..%5csecret.txt", "/sub%5c..%5c..%5csecret.txt"} {
+		if resp, body := get(t, srv, "GET", urlPath); strings.Contains(body, "top secret") {
+			t.Errorf("%s: got %d %q", urlPath, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestForbiddenNotCached(t *testing.T) {
+	files := map[string]string{".auth": "tok\n", "page.md": "# Page\n", "style.css": "p { color: red }\n", "docs/index.md": "# Docs\n"}
+	srv := newServer(t, files)
+	for _, urlPath := range []string{"/page", "/style.css", "/style.css?v=123", "/docs", "/docs/"} {
+		for _, cookie := range []string{"", "nerka=bad"} {
+			resp, _ := get(t, srv, "GET", urlPath, "Cookie", cookie)
+			if resp.StatusCode != 403 {
+				t.Errorf("%s with cookie %q: got %d", urlPath, cookie, resp.StatusCode)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+				t.Errorf("%s with cookie %q: got Cache-Control %q", urlPath, cookie, got)
+			}
+		}
+	}
+
+	// logging in takes effect at once
+	resp, _ := get(t, srv, "GET", "/page", "Cookie", "nerka=tok")
+	if resp.StatusCode != 200 || strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		t.Errorf("with a cookie: got %d, Cache-Control %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestHeadingAttributes(t *testing.T) {
+	files := map[string]string{"page.md": "# Page\n\n## Title {#custom}\n\n## Other {#other .note}\n\n{#given .lead}\n## Given Heading\n\n## Plain Heading\n"}
+	for _, test := range []struct {
+		opts  []Option
+		plain string
+	}{
+		{nil, "<h2>Plain Heading</h2>"},
+		{[]Option{Set("minify", "")}, "<h2>Plain Heading</h2>"},
+		{[]Option{Set("auto-heading-ids", "true")}, "<h2 id=plain-heading>Plain Heading</h2>"},
+		{[]Option{Set("auto-heading-ids", "true"), Set("heading-slugs", "github"), Set("slug-case", "keep")}, "<h2 id=Plain-Heading>Plain Heading</h2>"},
+	} {
+		srv := newServer(t, files, test.opts...)
+		_, body := get(t, srv, "GET", "/page")
+		body = strings.ReplaceAll(body, `"`, "")
+		for _, want := range []string{"<h2 id=custom>Title</h2>", "<h2 id=other class=note>Other</h2>", "<h2 id=given class=lead>Given Heading</h2>", test.plain} {
+			if !strings.Contains(body, want) {
+				t.Errorf("with %d options: %q lacks %q", len(test.opts), body, want)
+			}
+		}
+		if strings.Contains(strings.ToLower(body), "id=given-heading") {
+			t.Errorf("with %d options: a generated id besides the given one in %q", len(test.opts), body)
+		}
+	}
+}
+
+// testSite returns the site of files with opts
+func testSite(t *testing.T, files map[string]string, opts ...Option) *site {
+	t.Helper()
+	mapFS := fstest.MapFS{}
+	for name, data := range files {
+		mapFS[name] = &fstest.MapFile{Data: []byte(data)}
+	}
+	h, err := NewFS(mapFS, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Stop)
+	return h.defaultSite
+}
+
+// fragment parses src as the content of a body element
+func fragment(t *testing.T, src string) []*html.Node {
+	t.Helper()
+	nodes, err := html.ParseFragment(strings.NewReader(src), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nodes
+}
+
+func TestUpLink(t *testing.T) {
+	for _, test := range []struct{ urlPath, want string }{
+		{"/", ""},
+		{"/page", `<a href="../" class="up-arrow">↰ up</a>`},
+		{"/docs/", `<a href=".." class="up-arrow">↰ up</a>`},
+		{"/docs/page", `<a href="../docs/" class="up-arrow">↰ up</a>`},
+		{"/docs/sub/", `<a href=".." class="up-arrow">↰ up</a>`},
+	} {
+		if got := upLink(test.urlPath); got != test.want {
+			t.Errorf("upLink(%q) = %q, want %q", test.urlPath, got, test.want)
+		}
+	}
+}
+
+func TestIsTagPath(t *testing.T) {
+	for urlPath, want := range map[string]bool{"/tags": true, "/tags/": true, "/tags/go": true, "/tagsoup": false, "/docs/tags": false, "/": false} {
+		if got := isTagPath(urlPath); got != want {
+			t.Errorf("isTagPath(%q) = %v", urlPath, got)
+		}
+	}
+}
+
+func TestPageTitle(t *testing.T) {
+	content := fragment(t, "<h1>Page</h1><h2>Section</h2>")
+	for _, test := range []struct {
+		opts    []Option
+		content []*html.Node
+		urlPath string
+		want    string
+	}{
+		{nil, content, "/page", "nerka: Page"},
+		{nil, nil, "/docs/page", "nerka: docs/page"},
+		{nil, nil, "/", "nerka!"},
+		{[]Option{Set("site-name", "Site")}, content, "/page", "Site: Page"},
+		{[]Option{Set("title-format", "{{page}} | {{site}}")}, content, "/page", "Page | nerka"},
+		{[]Option{Set("no-branding", "true")}, content, "/page", "Page"},
+		{[]Option{Set("no-branding", "true"), Set("site-name", "Site")}, nil, "/", "Site"},
+	} {
+		s := testSite(t, nil, test.opts...)
+		if got := s.pageTitle(test.content, test.urlPath); got != test.want {
+			t.Errorf("pageTitle(%q) with %d options = %q, want %q", test.urlPath, len(test.opts), got, test.want)
+		}
+	}
+}
+
+func TestServeStatic(t *testing.T) {
+	s := testSite(t, map[string]string{"style.css": "p { color: red }\n", "style.css.gz": "gzipped", "data.bin": "\x00\x01"})
+	m := s.newMinifier()
+	for _, test := range []struct {
+		urlPath, name, encoding string
+		header                  map[string]string
+		body                    string
+	}{
+		{"/style.css", "style.css", "", map[string]string{"Content-Type": "text/css; charset=utf-8", "Cache-Control": "max-age=300, stale-while-revalidate=28800", "Vary": "Accept-Encoding"}, "p{color:red}"},
+		{"/style.css?v=1", "style.css", "", map[string]string{"Cache-Control": "max-age=31536000, immutable"}, "p{color:red}"},
+		{"/style.css", "style.css", "gzip, br", map[string]string{"Content-Encoding": "gzip"}, "gzipped"},
+		{"/style.css", "style.css", "br", map[string]string{"Content-Encoding": ""}, "p{color:red}"},
+		{"/data.bin", "data.bin", "", map[string]string{"Content-Encoding": ""}, "\x00\x01"},
+		{"/missing.css", "missing.css", "", nil, "open missing.css: file does not exist"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.urlPath, nil)
+		if test.encoding != "" {
+			r.Header.Set("Accept-Encoding", test.encoding)
+		}
+		s.serveStatic(w, r, test.name, m)
+		if got := w.Body.String(); got != test.body {
+			t.Errorf("%s with Accept-Encoding %q: got %q, want %q", test.urlPath, test.encoding, got, test.body)
+		}
+		for key, want := range test.header {
+			if got := w.Header().Get(key); got != want {
+				t.Errorf("%s with Accept-Encoding %q: got %s %q, want %q", test.urlPath, test.encoding, key, got, want)
+			}
+		}
+	}
+}
+
+func TestRenderIndex(t *testing.T) {
+	s := testSite(t, map[string]string{"docs/page.md": "# Page\n", "docs/notes.txt": "notes\n"})
+	listing, prev, next, err := s.renderIndex("/docs/", 1)
+	if err != nil || prev != "" || next != "" {
+		t.Fatalf("renderIndex: %q %q %v", prev, next, err)
+	}
+	for _, want := range []string{`href="page"`, `href="notes.txt"`} {
+		if !bytes.Contains(listing, []byte(want)) {
+			t.Errorf("listing %q lacks %q", listing, want)
+		}
+	}
+	if _, _, _, err := s.renderIndex("/missing/", 1); err == nil {
+		t.Errorf("renderIndex of a missing directory: no error")
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	s := testSite(t, nil)
+	if got, want := string(s.assemble("A & B", "<up>", "/page", []byte("<p>text</p>"))), "<title>A &amp; B</title>\n<up><p>text</p>"; got != want {
+		t.Errorf("assemble = %q, want %q", got, want)
+	}
+
+	s = testSite(t, map[string]string{".header": "<head><title>{{title}} - Site</title></head>\n", ".nav": "* [Home](/)\n"})
+	got := string(s.assemble("Title", "<up>", "/page", []byte("<p>text</p>")))
+	for _, want := range []string{"<title>Title - Site</title>", "<up>", `<nav class="site-nav">`, `<a href="/">Home</a>`, "<p>text</p>"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("assemble = %q, lacks %q", got, want)
+		}
+	}
+	if strings.Count(got, "<title>") != 1 {
+		t.Errorf("assemble = %q, adds a title to the one of the header", got)
+	}
+
+	// a title used in a heading of the header still leaves the page its own
+	s = testSite(t, map[string]string{".header": "<header><h1>{{title}}</h1></header>\n"})
+	if got, want := string(s.assemble("Title", "<up>", "/page", nil)), "<header><h1>Title</h1></header>\n<title>Title</title>\n<up>"; got != want {
+		t.Errorf("assemble = %q, want %q", got, want)
+	}
+}
+
+func TestHeaderTitle(t *testing.T) {
+	srv := newServer(t, map[string]string{".header": "<header><h1>{{title}}</h1></header>\n", "page.md": "Text\n"})
+	if _, body := get(t, srv, "GET", "/page"); !strings.Contains(body, "<title>nerka: page</title>") || !strings.Contains(body, "<h1>nerka: page</h1>") {
+		t.Errorf("/page: got %q", body)
+	}
+}
+
+func TestAnnotateLink(t *testing.T) {
+	s := testSite(t, map[string]string{"page.md": "# Page\n", "docs/index.md": "# Docs\n", "file.txt": "text\n"}, Set("external-new-tab", "true"))
+	for _, test := range []struct {
+		href, want string
+		broken     bool
+	}{
+		{"page.md", `<a href="page">`, false},
+		{"page.md#sec", `<a href="page#sec">`, false},
+		{"docs/index.md", `<a href="docs/">`, false},
+		{"file.txt", `<a href="file.txt">`, false},
+		{"missing", `<a href="missing" class="broken-link">`, true},
+		{"https://example.com/", `<a href="https://example.com/" class="external-link" target="_blank" rel="noopener noreferrer">`, false},
+	} {
+		n := fragment(t, `<a href="`+test.href+`"></a>`)[0]
+		href, broken := s.annotateLink(n, "/")
+		var b strings.Builder
+		html.Render(&b, n)
+		if got := strings.TrimSuffix(b.String(), "</a>"); got != test.want || href != test.href || broken != test.broken {
+			t.Errorf("annotateLink(%q) = %q, %q, %v", test.href, got, href, broken)
+		}
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	s := testSite(t, map[string]string{"page.md": "# Page\n"})
+	doc, err := html.Parse(strings.NewReader("<title>Page</title><h1>Page</h1><a href=\"page.md\">ok</a><a href=\"missing\">gone</a>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := s.annotate(doc, nil, "/", "page.md", nil, "", "")
+	if len(broken) != 1 || broken[0] != "missing" {
+		t.Errorf("annotate returned the broken links %q", broken)
+	}
+	var b strings.Builder
+	html.Render(&b, doc)
+	for _, want := range []string{`<body class="page home">`, `<a href="page">ok</a>`, `<a href="missing" class="broken-link">gone</a>`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("annotated page %q lacks %q", b.String(), want)
+		}
+	}
+}
+
+// chain follows the redirects from urlPath, returning the statuses and
+// paths on the way and the final body
+func chain(t *testing.T, srv *httptest.Server, urlPath string) ([]string, string) {
+	t.Helper()
+	var steps []string
+	for i := 0; i < 5; i++ {
+		resp, body := get(t, srv, "GET", urlPath)
+		steps = append(steps, strconv.Itoa(resp.StatusCode)+" "+urlPath)
+		if resp.StatusCode/100 != 3 {
+			return steps, body
+		}
+		next, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		urlPath = next.Path
+	}
+	t.Fatalf("%q: too many redirects", steps)
+	return nil, ""
+}
+
+func TestDirRedirectChain(t *testing.T) {
+	files := map[string]string{"docs/index.md": "# Docs\n\n[page](page)\n", "docs/page.md": "# Page\n", "docs/sub/index.md": "# Sub\n"}
+	for _, test := range []struct {
+		status string
+		chains map[string][]string
+	}{
+		{"303", map[string][]string{
+			"/docs":       {"303 /docs", "200 /docs/"},
+			"/docs/":      {"200 /docs/"},
+			"/docs/sub":   {"303 /docs/sub", "200 /docs/sub/"},
+			"/docs/page/": {"303 /docs/page/", "200 /docs/page"},
+		}},
+		{"301", map[string][]string{
+			"/docs":       {"301 /docs", "200 /docs/"},
+			"/docs/sub":   {"301 /docs/sub", "200 /docs/sub/"},
+			"/docs/page/": {"301 /docs/page/", "200 /docs/page"},
+		}},
+		{"308", map[string][]string{
+			"/docs":       {"308 /docs", "200 /docs/"},
+			"/docs/page/": {"308 /docs/page/", "200 /docs/page"},
+		}},
+		{"0", map[string][]string{
+			"/docs":       {"200 /docs"},
+			"/docs/":      {"200 /docs/"},
+			"/docs/sub":   {"200 /docs/sub"},
+			"/docs/page/": {"303 /docs/page/", "200 /docs/page"},
+		}},
+	} {
+		srv := newServer(t, files, Set("dir-redirect", test.status))
+		for urlPath, want := range test.chains {
+			got, body := chain(t, srv, urlPath)
+			if strings.Join(got, ", ") != strings.Join(want, ", ") {
+				t.Errorf("-dir-redirect %s: %s went %q, want %q", test.status, urlPath, got, want)
+			}
+			if urlPath == "/docs" && !strings.Contains(body, "<h1>Docs</h1>") {
+				t.Errorf("-dir-redirect %s: %s ended at %q", test.status, urlPath, body)
+			}
+		}
+	}
+
+	// relative links on the index served at the directory without a slash
+	// resolve against the parent, as they do in the browser
+	srv := newServer(t, files, Set("dir-redirect", "0"))
+	if _, body := get(t, srv, "GET", "/docs"); !strings.Contains(body, "<a href=page class=broken-link>") {
+		t.Errorf("-dir-redirect 0: /docs is %q", body)
+	}
+	if _, body := get(t, srv, "GET", "/docs/"); strings.Contains(body, "<a href=page class=broken-link>") {
+		t.Errorf("-dir-redirect 0: /docs/ is %q", body)
+	}
+
+	if _, err := NewFS(fstest.MapFS{}, Set("dir-redirect", "200")); err == nil {
+		t.Errorf("-dir-redirect 200: no error")
+	}
+}
+
+func TestMethods(t *testing.T) {
+	srv := newServer(t, pages, Set("events", "/events"))
+	for _, test := range []struct {
+		method, urlPath string
+		status          int
+		allow, body     string
+	}{
+		{"GET", "/page", 200, "", ""},
+		{"HEAD", "/page", 200, "", ""},
+		{"OPTIONS", "/page", 204, "GET, HEAD, OPTIONS", ""},
+		{"OPTIONS", "/style.css", 204, "GET, HEAD, OPTIONS", ""},
+		{"OPTIONS", "/docs/", 204, "GET, HEAD, OPTIONS", ""},
+		{"POST", "/page", 405, "GET, HEAD, OPTIONS", "method not allowed"},
+		{"PUT", "/style.css", 405, "GET, HEAD, OPTIONS", "method not allowed"},
+		{"DELETE", "/docs/", 405, "GET, HEAD, OPTIONS", "method not allowed"},
+		{"PATCH", "/", 405, "GET, HEAD, OPTIONS", "method not allowed"},
+		{"POST", "/.auth/tok", 303, "", ""},
+		{"OPTIONS", "/.auth/tok", 204, "GET, HEAD, POST, OPTIONS", ""},
+		{"PUT", "/.auth/tok", 405, "GET, HEAD, POST, OPTIONS", "method not allowed"},
+		{"OPTIONS", "/events", 204, "GET, HEAD, OPTIONS", ""},
+		{"POST", "/events", 405, "GET, HEAD, OPTIONS", "method not allowed"},
+	} {
+		resp, body := get(t, srv, test.method, test.urlPath)
+		if resp.StatusCode != test.status || resp.Header.Get("Allow") != test.allow {
+			t.Errorf("%s %s: got %d with Allow %q, want %d with %q", test.method, test.urlPath, resp.StatusCode, resp.Header.Get("Allow"), test.status, test.allow)
+		}
+		if test.status != 200 && body != test.body {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.urlPath, body, test.body)
+		}
+		if test.method == "HEAD" && body != "" {
+			t.Errorf("%s %s: got a body %q", test.method, test.urlPath, body)
+		}
+	}
+}
+
+func TestVersionedAssets(t *testing.T) {
+	const static, immutable = "max-age=300, stale-while-revalidate=28800", "max-age=31536000, immutable"
+	for _, test := range []struct {
+		opts                 []Option
+		urlPath, cacheHeader string
+	}{
+		{nil, "/style.css?v=123", immutable},
+		{nil, "/style.css?x=1&v=abc", immutable},
+		{nil, "/style.css", static},
+		{nil, "/style.css?v=", static},
+		{nil, "/style.css?x=123", static},
+		{[]Option{Set("version-param", "rev")}, "/style.css?rev=2", immutable},
+		{[]Option{Set("version-param", "rev")}, "/style.css?v=2", static},
+		{[]Option{Set("version-param", "")}, "/style.css?v=2", static},
+		{[]Option{Set("versioned-cache-control", "max-age=60")}, "/style.css?v=2", "max-age=60"},
+	} {
+		srv := newServer(t, pages, test.opts...)
+		resp, body := get(t, srv, "GET", test.urlPath)
+		if resp.StatusCode != 200 || body != "body{color:red}" {
+			t.Errorf("%s with %d options: got %d %q", test.urlPath, len(test.opts), resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != test.cacheHeader {
+			t.Errorf("%s with %d options: got Cache-Control %q, want %q", test.urlPath, len(test.opts), got, test.cacheHeader)
+		}
+	}
+
+	// pages are not versioned
+	srv := newServer(t, pages)
+	if resp, _ := get(t, srv, "GET", "/page?v=1"); resp.Header.Get("Cache-Control") == immutable {
+		t.Errorf("/page?v=1: cached as immutable")
+	}
+}
+
+// logBuffer collects what handlers log
+type logBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+func TestShadow(t *testing.T) {
+	files := map[string]string{"foo.md": "# Foo Page\n", "foo/index.md": "# Foo Dir\n", "foo/bar.md": "# Bar\n"}
+	for _, test := range []struct {
+		shadow     string
+		foo, slash string
+	}{
+		{"page", "200 Foo Page", "303 ../foo"},
+		{"dir", "303 foo/", "200 Foo Dir"},
+	} {
+		h, err := New(fixture(t, files), Set("shadow", test.shadow))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var logged logBuffer
+		h.logger = log.New(&logged, "", 0)
+		srv := serve(t, h)
+		for urlPath, want := range map[string]string{"/foo": test.foo, "/foo/": test.slash, "/foo/bar": "200 Bar"} {
+			for i := 0; i < 2; i++ {
+				resp, body := get(t, srv, "GET", urlPath)
+				got := strconv.Itoa(resp.StatusCode) + " " + resp.Header.Get("Location")
+				if resp.StatusCode == 200 {
+					got = strconv.Itoa(resp.StatusCode) + " " + strings.TrimPrefix(strings.SplitN(body, "</title>", 2)[0], "<title>nerka: ")
+				}
+				if got != want {
+					t.Errorf("-shadow %s: %s got %q, want %q", test.shadow, urlPath, got, want)
+				}
+			}
+		}
+		if want := "/foo: a page and a directory share the name, -shadow is " + test.shadow + "\n"; logged.String() != want {
+			t.Errorf("-shadow %s: logged %q, want %q once", test.shadow, logged.String(), want)
+		}
+	}
+
+	if _, err := NewFS(fstest.MapFS{}, Set("shadow", "both")); err == nil {
+		t.Errorf("-shadow both: no error")
+	}
+}
+
+func TestVary(t *testing.T) {
+	for _, test := range []struct {
+		before []string
+		fields string
+		want   string
+	}{
+		{nil, "Cookie", "Cookie"},
+		{[]string{"Cookie"}, "Cookie", "Cookie"},
+		{[]string{"Cookie"}, "cookie", "Cookie"},
+		{[]string{"Cookie"}, "Accept-Encoding", "Cookie, Accept-Encoding"},
+		{[]string{"Cookie, Accept-Language"}, "accept-language, Origin", "Cookie, Accept-Language, Origin"},
+		{[]string{"Origin", "Cookie,Origin"}, " origin ,, Cookie ", "Origin, Cookie"},
+	} {
+		w := httptest.NewRecorder()
+		for _, value := range test.before {
+			w.Header().Add("Vary", value)
+		}
+		vary(w, test.fields)
+		if got := w.Header().Values("Vary"); len(got) != 1 || got[0] != test.want {
+			t.Errorf("vary(%q, %q) = %q, want %q", test.before, test.fields, got, test.want)
+		}
+	}
+}
+
+func TestVaryHeader(t *testing.T) {
+	files := map[string]string{".auth": "tok\n", "page.md": "# Page\n", "page.fr.md": "# Page\n", "style.css": "p { color: red }\n"}
+	for _, test := range []struct {
+		opts          []Option
+		urlPath, want string
+	}{
+		{nil, "/page", "Cookie"},
+		{nil, "/style.css", "Cookie, Accept-Encoding"},
+		{[]Option{Set("languages", "en,fr")}, "/page", "Cookie, Accept-Language"},
+		{[]Option{Set("languages", "en,fr"), Set("header", "Vary: Origin")}, "/page", "Cookie, Accept-Language, Origin"},
+		{[]Option{Set("languages", "en,fr"), Set("header", "Vary: cookie, Origin")}, "/page", "Cookie, Accept-Language, Origin"},
+		{[]Option{Set("header", "Vary: Origin, accept-encoding")}, "/style.css", "Cookie, Accept-Encoding, Origin"},
+		{[]Option{Set("header", "Vary: Origin"), Set("header", "Vary: Origin")}, "/style.css", "Cookie, Accept-Encoding, Origin"},
+		{[]Option{Set("force-header", "Vary: Origin")}, "/style.css", "Origin"},
+	} {
+		srv := newServer(t, files, test.opts...)
+		resp, _ := get(t, srv, "GET", test.urlPath, "Cookie", "nerka=tok")
+		if got := resp.Header.Values("Vary"); resp.StatusCode != 200 || len(got) != 1 || got[0] != test.want {
+			t.Errorf("%s with %d options: got %d with Vary %q, want %q", test.urlPath, len(test.opts), resp.StatusCode, got, test.want)
+		}
+	}
+}
+
+func TestAuthBlocksInSources(t *testing.T) {
+	files := map[string]string{
+		".auth":        "tok\n",
+		"notes.txt":    "public\n{{#auth}}top secret{{/auth}}\n",
+		"notes.txt.gz": "top secret, compressed",
+		"nb.ipynb":     `{"cells": [{"cell_type": "markdown", "source": ["{{#auth}}top secret{{/auth}}"]}]}`,
+		"plain.txt":    "public\n",
+	}
+	srv := newServer(t, files, Set("auth-optional", "true"), Set("txt-pages", "true"))
+	for _, urlPath := range []string{"/notes.txt", "/nb.ipynb"} {
+		for _, header := range [][]string{nil, {"Accept-Encoding", "gzip"}, {"Cookie", "nerka=bad"}} {
+			resp, body := get(t, srv, "GET", urlPath, header...)
+			if strings.Contains(body, "top secret") || resp.StatusCode != 404 || resp.Header.Get("Cache-Control") != "no-store" {
+				t.Errorf("%s logged out with %q: got %d, Cache-Control %q, %q", urlPath, header, resp.StatusCode, resp.Header.Get("Cache-Control"), body)
+			}
+		}
+		if resp, body := get(t, srv, "GET", urlPath, "Cookie", "nerka=tok", "Accept-Encoding", "identity"); resp.StatusCode != 200 || !strings.Contains(body, "top secret") {
+			t.Errorf("%s logged in: got %d %q", urlPath, resp.StatusCode, body)
+		}
+	}
+	if resp, body := get(t, srv, "GET", "/plain.txt"); resp.StatusCode != 200 || body != "public\n" {
+		t.Errorf("/plain.txt logged out: got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := get(t, srv, "GET", "/notes"); resp.StatusCode != 200 || !strings.Contains(body, "public") || strings.Contains(body, "top secret") {
+		t.Errorf("/notes logged out: got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestFrontmatter(t *testing.T) {
+	for _, test := range []struct {
+		file, body string
+		meta       map[string]string
+	}{
+		{"---\ntitle: T\ntags: go, web\n---\n# Page\n", "# Page\n", map[string]string{"title": "T", "tags": "go, web"}},
+		{"---\ntitle: T\n\nurl: http://x\n---\nText\n", "Text\n", map[string]string{"title": "T", "url": "http://x"}},
+		{"---\nIntro line\n---\nText\n", "---\nIntro line\n---\nText\n", map[string]string{}},
+		{"---\ntitle: T\nIntro line\n---\nText\n", "---\ntitle: T\nIntro line\n---\nText\n", map[string]string{}},
+		{"---\n---\nText\n", "---\n---\nText\n", map[string]string{}},
+		{"---\ntitle: T\n", "---\ntitle: T\n", map[string]string{}},
+		{"# Page\n---\ntitle: T\n---\n", "# Page\n---\ntitle: T\n---\n", map[string]string{}},
+	} {
+		meta, body := frontmatter([]byte(test.file))
+		if string(body) != test.body || len(meta) != len(test.meta) {
+			t.Errorf("frontmatter(%q) = %q, %q", test.file, meta, body)
+			continue
+		}
+		for key, value := range test.meta {
+			if meta[key] != value {
+				t.Errorf("frontmatter(%q) = %q, %q", test.file, meta, body)
+			}
+		}
+	}
+
+	srv := newServer(t, map[string]string{"page.md": "---\nIntro line\n---\n\nText\n"})
+	if _, body := get(t, srv, "GET", "/page"); !strings.Contains(body, "Intro line") || !strings.Contains(body, "<hr>") {
+		t.Errorf("/page: got %q", body)
+	}
+}
+
+func TestLanguageVariants(t *testing.T) {
+	files := map[string]string{
+		"docs/a.md":       "---\ntags: go\n---\n# A\n",
+		"docs/page.md":    "---\ntags: go\n---\n# Page\n",
+		"docs/page.fr.md": "---\ntags: go\n---\n# Page en français\n",
+		"docs/z.md":       "# Z\n",
+		"docs/notes.fr":   "a file with a language extension\n",
+	}
+	s := testSite(t, files, Set("languages", "en,fr"), Set("page-nav", "alpha"), Set("tags", "true"))
+
+	entries, err := s.listDir("/docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if got := strings.Join(names, " "); got != "a notes.fr page z" {
+		t.Errorf("listed %q", got)
+	}
+	if prev, next := s.neighbours("/docs/page"); prev != "a" || next != "z" {
+		t.Errorf("neighbours of page: %q, %q", prev, next)
+	}
+	if prev, next := s.neighbours("/docs/a"); prev != "" || next != "page" {
+		t.Errorf("neighbours of a: %q, %q", prev, next)
+	}
+	if err := s.indexTags(); err != nil {
+		t.Fatal(err)
+	}
+	if _, entries, _ := s.tagEntries("go"); len(entries) != 2 {
+		t.Errorf("tagged %v", entries)
+	}
+
+	srv := newServer(t, files, Set("languages", "en,fr"), Set("page-nav", "alpha"))
+	nav := `<nav class=page-nav><a href=a rel=prev>← a</a> <a href=z rel=next>z →</a></nav>`
+	for _, urlPath := range []string{"/docs/page", "/docs/page.fr", "/docs/page?lang=fr"} {
+		if _, body := get(t, srv, "GET", urlPath); !strings.Contains(body, nav) {
+			t.Errorf("%s: got %q, want the nav %q", urlPath, body, nav)
+		}
+	}
+}
+
+func TestRestructuredTextSafety(t *testing.T) {
+	rst2html := converter(t, `printf '<html><body>args: %s.</body></html>' "$*"`)
+	for rawHTML, want := range map[string]string{"allow": "args: --no-file-insertion.", "skip": "args: --no-file-insertion --no-raw.", "escape": "args: --no-file-insertion --no-raw."} {
+		srv := newServer(t, map[string]string{"doc.rst": ".. include:: /etc/passwd\n"}, Set("rst2html", rst2html), Set("raw-html", rawHTML))
+		if _, body := get(t, srv, "GET", "/doc"); !strings.Contains(body, want) {
+			t.Errorf("-raw-html %s: got %q, want %q", rawHTML, body, want)
+		}
+	}
+}
+
+func TestInlineHidden(t *testing.T) {
+	files := map[string]string{
+		".auth":             "tok\n",
+		"style.css":         "p{color:red}",
+		"wip/.draft":        "",
+		"wip/style.css":     "p{color:blue}",
+		"wip/dot.png":       "\x89PNG draft",
+		".well-known/a.css": "p{color:green}",
+		"page.md": "# Page\n\n" +
+			"<link rel=\"stylesheet\" href=\"/.auth\"><link rel=\"stylesheet\" href=\"docs/../.auth\">" +
+			"<link rel=\"stylesheet\" href=\"wip/style.css\"><link rel=\"stylesheet\" href=\"style.css\">" +
+			"<link rel=\"stylesheet\" href=\"/.well-known/a.css\"><img src=\"wip/dot.png\">\n",
+	}
+	srv := newServer(t, files, Set("inline-max-size", "1000"), Set("auth-optional", "true"))
+	_, body := get(t, srv, "GET", "/page")
+	for _, leak := range []string{"tok", "color:blue", "data:image/png"} {
+		if strings.Contains(body, leak) {
+			t.Errorf("/page inlines %q: %q", leak, body)
+		}
+	}
+	for _, want := range []string{"<style>p{color:red}</style>", "<style>p{color:green}</style>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/page lacks %q: %q", want, body)
+		}
+	}
+}
+
+func TestEventsHeaders(t *testing.T) {
+	srv := newServer(t, pages, Set("events", "/events"), Set("events-interval", "10ms"), Set("header", "X-Test: 1"))
+	if resp, _ := get(t, srv, "HEAD", "/events"); resp.StatusCode != 200 || resp.Header.Get("X-Test") != "1" {
+		t.Errorf("HEAD /events: got %d with X-Test %q", resp.StatusCode, resp.Header.Get("X-Test"))
+	}
+
+	// the stream is flushed through the header writer
+	resp, err := client.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Test") != "1" || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("GET /events: got X-Test %q, Content-Type %q", resp.Header.Get("X-Test"), resp.Header.Get("Content-Type"))
+	}
+	ping := make([]byte, len("event: ping\n"))
+	if _, err := io.ReadFull(resp.Body, ping); err != nil || string(ping) != "event: ping\n" {
+		t.Errorf("GET /events: read %q, %v", ping, err)
+	}
+}
+
+func TestBrokenLinksHeader(t *testing.T) {
+	s := testSite(t, nil, Set("broken-links-header", "true"))
+	for _, links := range [][]string{
+		{strings.Repeat("é", 2000)},
+		{"a", strings.Repeat("€", 1000)},
+		{strings.Repeat("x", 3000)},
+	} {
+		w := httptest.NewRecorder()
+		s.reportBrokenLinks(w, "/page", links)
+		got := w.Header().Get("X-Broken-Links")
+		if len(got) > maxBrokenLinksHeader || !utf8.ValidString(got) || !strings.HasSuffix(got, "...") {
+			t.Errorf("X-Broken-Links of %d bytes, valid UTF-8 %v, ending %q", len(got), utf8.ValidString(got), got[len(got)-5:])
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.reportBrokenLinks(w, "/page", []string{"a", "b"})
+	if got := w.Header().Get("X-Broken-Links"); got != "a, b" {
+		t.Errorf("X-Broken-Links %q", got)
+	}
+}